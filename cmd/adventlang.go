@@ -3,11 +3,18 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
 
 	"github.com/healeycodes/adventlang/pkg/adventlang"
 )
 
 func main() {
+	maxDepth := flag.Int("max-depth", adventlang.DefaultMaxRecursionDepth, "the maximum depth of nested function calls")
+	treeWalker := flag.Bool("tree-walker", false, "evaluate the syntax tree instead of compiling to bytecode")
+	noOptimise := flag.Bool("no-opt", false, "skip constant folding and dead branch removal")
+	maxSteps := flag.Int("max-steps", 0, "stop after this many statements and loop iterations (0 is no limit)")
+	timeout := flag.Duration("timeout", 0, "stop after running for this long e.g. 10s (0 is no limit)")
+	maxMemory := flag.Int64("max-memory", 0, "stop after allocating about this many bytes of lists, dicts, and strings (0 is no limit)")
 	flag.Parse()
 	filename := flag.Arg(0)
 	if filename == "" {
@@ -15,10 +22,23 @@ func main() {
 		os.Exit(1)
 	}
 
-	source := adventlang.ReadProgram(filename)
+	source, err := adventlang.ReadProgram(filename)
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
 
 	// For now, don't print the final statement's value
-	_, _, err := adventlang.RunProgram(filename, source)
+	_, _, err = adventlang.RunProgramWithOptions(filename, source, adventlang.Options{
+		MaxRecursionDepth: *maxDepth,
+		TreeWalker:        *treeWalker,
+		NoOptimise:        *noOptimise,
+		MaxSteps:          *maxSteps,
+		Timeout:           *timeout,
+		MaxMemory:         *maxMemory,
+		// Where imports are looked for when they aren't in the working directory
+		ModulePath: filepath.SplitList(os.Getenv("ADVENTLANG_PATH")),
+	})
 	if err != nil {
 		println("uh oh.. while running: "+filename, err.Error(), "\n")
 		os.Exit(1)
@@ -13,18 +13,14 @@ const runtime = (async () => {
   go.run(result.instance);
 })();
 
+// Messages are either the source, or {source, files} where files is an
+// object of file contents by path that the program can import and read
 onmessage = async (e) => {
   await runtime;
+  const { source, files } =
+    typeof e.data === "string" ? { source: e.data, files: {} } : e.data;
 
   const start = Date.now();
-
-  // Capture log()
-  let logs = "";
-  self.console.log = (s) => (logs += `${s}\n`);
-
-  // Don't capture the result returned here
-  // (aka the final statement value)
-  self.adventlang(e.data);
-
-  postMessage([`${logs}`, Date.now() - start]);
+  const output = self.adventlang(source, files);
+  postMessage([output, Date.now() - start]);
 };
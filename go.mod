@@ -1,5 +1,5 @@
 module github.com/healeycodes/adventlang
 
-go 1.14
+go 1.16
 
 require github.com/alecthomas/participle/v2 v2.0.0-alpha7
@@ -0,0 +1,8 @@
+// Package lib embeds the standard library, which programs import by name
+// e.g. `import("std/utils")`
+package lib
+
+import "embed"
+
+//go:embed *.adv
+var FS embed.FS
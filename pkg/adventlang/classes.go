@@ -0,0 +1,113 @@
+package adventlang
+
+import (
+	"fmt"
+)
+
+// Calling a class creates an instance, a dict that remembers its class
+type ClassValue struct {
+	name    string
+	frame   *StackFrame
+	members []*ClassMember
+	// The compiled members and their frame's scope, nil when running on
+	// the tree-walker
+	code  []*chunk
+	scope *scope
+}
+
+func (classValue ClassValue) String() string {
+	return "class " + classValue.name
+}
+
+func (classValue ClassValue) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (classStatement ClassStatement) String() string {
+	return "class statement"
+}
+
+func (classStatement ClassStatement) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (classStatement ClassStatement) Eval(frame *StackFrame) (Value, error) {
+	frame.declare(classStatement.Name, ClassValue{
+		name:    classStatement.Name,
+		frame:   frame,
+		members: classStatement.Members,
+	})
+	return UndefinedValue{}, nil
+}
+
+// Members are evaluated for every instance so that e.g. `items = [];`
+// isn't shared. Functions are bound to the instance as `self`
+func (classValue ClassValue) instantiate(frame *StackFrame, position string, args []Value) (Value, error) {
+	instance := newDictValue(0)
+	instance.class = &classValue
+	trace := frame.filename + ":" + position + ": " + classValue.name + " constructor"
+	var memberFrame *StackFrame
+	if classValue.code != nil {
+		memberFrame = classValue.frame.child(trace, classValue.scope)
+	} else {
+		memberFrame = classValue.frame.GetChild(trace)
+	}
+	fields := make([]string, 0)
+	for i, member := range classValue.members {
+		var value Value
+		var err error
+		if classValue.code != nil {
+			value, err = execChunk(memberFrame, classValue.code[i])
+		} else {
+			value, err = member.Value.Eval(memberFrame)
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, err = unwrap(value, memberFrame)
+		if err != nil {
+			return nil, traceError(memberFrame, member.Pos.String(), err.Error())
+		}
+		if function, okFunction := value.(FunctionValue); okFunction {
+			function.self = instance
+			if function.name == "" {
+				function.name = classValue.name + "." + member.Name
+			}
+			value = function
+		} else {
+			fields = append(fields, member.Name)
+		}
+		instance.Set(member.Name, value)
+	}
+
+	// An `init` method is the constructor, otherwise arguments fill the
+	// fields in the order they're declared
+	if init, okInit := getMethod(instance, "init"); okInit {
+		_, err := callFunction(frame, position, init, args)
+		if err != nil {
+			return nil, err
+		}
+		return instance, nil
+	}
+	if len(args) > len(fields) {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("%v: too many arguments, wanted at most: %v, got: %v", classValue.name, len(fields), len(args)))
+	}
+	for i, arg := range args {
+		instance.Set(fields[i], arg)
+	}
+	return instance, nil
+}
+
+// Look up a method on a class instance
+func getMethod(value Value, name string) (Value, bool) {
+	dictValue, okDict := value.(DictValue)
+	if !okDict || dictValue.class == nil {
+		return nil, false
+	}
+	method, okMethod := dictValue.val[name]
+	if !okMethod || !isFunction(*method) {
+		return nil, false
+	}
+	return *method, true
+}
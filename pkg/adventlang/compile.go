@@ -0,0 +1,1068 @@
+package adventlang
+
+// Programs are compiled to bytecode which runs on a stack machine (see vm.go).
+// Each program, function body, and class member is compiled to its own chunk.
+// The machine reuses the tree-walker's frames, values, and operators so that
+// the two give the same results and the same errors.
+//
+// Variables live in slots of their frame. A variable is declared in the
+// nearest frame that has it, or else the current one, so a name resolves
+// to every enclosing frame that may declare it, innermost first
+
+type opcode byte
+
+const (
+	// Push constants[a]
+	opConstant opcode = iota
+	opUndefined
+	opPop
+	// Replace a reference on top of the stack with its value
+	opUnref
+	// Push variables[a]. When there's a position, a missing variable is
+	// reported there
+	opGetVar
+	// Push the identifier names[a] to be resolved later
+	opIdentifier
+	// Assign the top of the stack to variables[a]. Constants remember
+	// the position of their declaration, names[b]
+	opAssign
+	opLet
+	opConst
+	// Pop into slot a of the current frame
+	opDeclare
+	// Pop a value and assign it to the reference below it
+	opStoreRef
+	// Operators. a is the operator's family and names[b] is the operator
+	opBinary
+	opUnary
+	// Operators with a fast path for numbers
+	opAdd
+	opSubtract
+	opMultiply
+	opLess
+	opLessEqual
+	opGreater
+	opGreaterEqual
+	opEqual
+	opNotEqual
+	// Jumps are to the instruction at a
+	opJump
+	// Pop a condition and jump if it's false
+	opTernary
+	// The same, but errors are reported from the frame that encloses the
+	// if statement's frame
+	opIf
+	opLoopCondition
+	// Jump if the top of the stack isn't undefined, otherwise pop it
+	opNullish
+	// Jump if the top of the stack is undefined
+	opOptional
+	// Index the value below the index. a is 1 for optional links and
+	// names[b] is the position of the index expression
+	opIndex
+	// Read property names[a]. b holds the property flags
+	opProperty
+	// Call the function below a arguments
+	opCall
+	// The same, but the value below the function is the first argument
+	opCallPiped
+	// Call the function on top of the stack with the value below it
+	opPipe
+	// Drop the value below the top of the stack
+	opNip
+	// Call the function below a arguments, deferring it to the caller
+	// when it's a user function
+	opTailCall
+	opReturn
+	// Raise the return of a value outside of a function
+	opReturnOutside
+	opYield
+	// Enter a child frame with the trace names[a] and the scope scopes[b]
+	opPushFrame
+	opPopFrame
+	// Push functions[a] closed over the current frame
+	opClosure
+	// Declare classes[a] in slot b of the current frame
+	opClass
+	// Pop a items into a list, and count them towards the memory limit
+	opList
+	opNewList
+	opNewDict
+	// Pop a value, and append it to the list a values below it
+	opAppend
+	// Pop a key and a value, and set them on the dict a values below them
+	opDictItem
+	// Replace the iterable on top of the stack with its iterator
+	opIterate
+	// Push the next item of the iterator, or jump when it's done.
+	// b is 2 when both the key and the value are pushed
+	opNext
+	// Pop the iterator, closing it if the loop stopped before it was done
+	opEndIterate
+	// Start a loop that breaks to a and continues at b
+	opPushLoop
+	opPopLoop
+	// Jump to the loop that's a loops out from the innermost
+	opBreak
+	opContinue
+	// Raise a break or continue to a loop of a calling function, or with
+	// the unknown label names[a]
+	opBreakError
+	opContinueError
+	// Raise the error names[a]
+	opError
+	// Pop a statement's value, a program's result is its last statement
+	opSetResult
+	opResult
+	// Count a statement or a loop iteration towards the program's limits
+	opStep
+)
+
+const (
+	propertyOptional = 1
+	propertyCalled   = 2
+)
+
+type instruction struct {
+	op       opcode
+	a        int
+	b        int
+	position string
+}
+
+type chunk struct {
+	code      []instruction
+	constants []Value
+	names     []string
+	variables []*variable
+	scopes    []*scope
+	functions []*functionTemplate
+	classes   []*classTemplate
+	// A function body's frame, and the slots of its parameters and `self`
+	scope      *scope
+	parameters []int
+	self       int
+}
+
+type variable struct {
+	name string
+	// The frames that may declare the variable, innermost first
+	addresses []address
+	// The variable's slot when the current frame declares it, otherwise -1
+	local int
+}
+
+// A slot of the frame that's depth frames out from the current one
+type address struct {
+	depth int
+	slot  int
+}
+
+type functionTemplate struct {
+	name       string
+	position   string
+	parameters []string
+	types      []*TypeExpr
+	statements []*Statement
+	generator  bool
+	code       *chunk
+}
+
+type classTemplate struct {
+	name    string
+	members []*ClassMember
+	code    []*chunk
+	scope   *scope
+}
+
+// Binary operators share their implementation with the tree-walker
+const (
+	familyLogic = iota
+	familyEquality
+	familyComparison
+	familyBitwiseOr
+	familyInteger
+	familyAddition
+	familyMultiplication
+	familyPower
+)
+
+func evalBinary(frame *StackFrame, family int, position string, op string, left Value, right Value) (Value, error) {
+	switch family {
+	case familyLogic:
+		return evalLogic(frame, position, op, left, right)
+	case familyEquality:
+		return evalEquality(frame, position, op, left, right)
+	case familyComparison:
+		return evalComparison(frame, position, op, left, right)
+	case familyBitwiseOr:
+		return evalBitwiseOr(frame, position, op, left, right)
+	case familyInteger:
+		return evalIntegerOp(frame, position, op, left, right)
+	case familyAddition:
+		return evalAddition(frame, position, op, left, right)
+	case familyMultiplication:
+		return evalMultiplication(frame, position, op, left, right)
+	case familyPower:
+		return evalPower(frame, position, op, left, right)
+	}
+	panic("unreachable")
+}
+
+type compiler struct {
+	filename string
+	chunk    *chunk
+	// The scope of the frame that the code runs in
+	scope     *compileScope
+	variables map[reference]int
+	// Variables are resolved once every scope of the program is laid out
+	resolver *resolver
+	// The labels of the loops being compiled, innermost last
+	loops []*string
+	// Whether returns leave a function, otherwise they're an error
+	inFunction bool
+	// Whether statements are in a position that sets the program's result
+	result bool
+}
+
+// A frame's scope while it's being compiled
+type compileScope struct {
+	layout *scope
+	parent *compileScope
+}
+
+type reference struct {
+	name  string
+	scope *compileScope
+}
+
+type resolver struct {
+	variables []*variable
+	scopes    []*compileScope
+}
+
+// The top-level scope is the program's frame, which also has the builtins
+func compileProgram(filename string, program *Program, global *scope) *chunk {
+	c := compiler{
+		filename: filename,
+		chunk:    &chunk{},
+		scope:    &compileScope{layout: global},
+		resolver: &resolver{},
+		result:   true,
+	}
+	c.block(program.Statements)
+	c.emit(opResult, 0, 0, "")
+	c.emit(opReturn, 0, 0, "")
+	c.resolver.resolve()
+	return c.chunk
+}
+
+func (resolver *resolver) resolve() {
+	for i, variable := range resolver.variables {
+		depth := 0
+		scope := resolver.scopes[i]
+		for ; scope.parent != nil; scope = scope.parent {
+			if slot, ok := scope.layout.index[variable.name]; ok {
+				variable.addresses = append(variable.addresses, address{depth: depth, slot: slot})
+			}
+			depth++
+		}
+		// Anything else is global e.g. a builtin
+		variable.addresses = append(variable.addresses, address{depth: depth, slot: scope.layout.slot(variable.name)})
+	}
+}
+
+// A compiler for code that runs in another frame
+func (c *compiler) nested(scope *compileScope) compiler {
+	return compiler{filename: c.filename, chunk: &chunk{}, scope: scope, resolver: c.resolver}
+}
+
+func (c *compiler) function(parameters []string, statements []*Statement) *chunk {
+	scope := &compileScope{layout: newScope(), parent: c.scope}
+	functionCompiler := c.nested(scope)
+	functionCompiler.inFunction = true
+	code := functionCompiler.chunk
+	for _, parameter := range parameters {
+		code.parameters = append(code.parameters, scope.layout.slot(parameter))
+	}
+	code.self = scope.layout.slot("self")
+	functionCompiler.block(statements)
+	functionCompiler.emit(opUndefined, 0, 0, "")
+	functionCompiler.emit(opReturn, 0, 0, "")
+	code.scope = scope.layout
+	return code
+}
+
+func (c *compiler) emit(op opcode, a int, b int, position string) int {
+	c.chunk.code = append(c.chunk.code, instruction{op: op, a: a, b: b, position: position})
+	return len(c.chunk.code) - 1
+}
+
+// Point a jump at the next instruction
+func (c *compiler) patch(jump int) {
+	c.chunk.code[jump].a = len(c.chunk.code)
+}
+
+func (c *compiler) constant(value Value) int {
+	c.chunk.constants = append(c.chunk.constants, value)
+	return len(c.chunk.constants) - 1
+}
+
+func (c *compiler) name(name string) int {
+	for i, existing := range c.chunk.names {
+		if existing == name {
+			return i
+		}
+	}
+	c.chunk.names = append(c.chunk.names, name)
+	return len(c.chunk.names) - 1
+}
+
+// A variable as it's seen from the current scope
+func (c *compiler) variable(name string) int {
+	key := reference{name: name, scope: c.scope}
+	if i, ok := c.variables[key]; ok {
+		return i
+	}
+	if c.variables == nil {
+		c.variables = make(map[reference]int)
+	}
+	variable := &variable{name: name, local: -1}
+	c.chunk.variables = append(c.chunk.variables, variable)
+	c.variables[key] = len(c.chunk.variables) - 1
+	c.resolver.variables = append(c.resolver.variables, variable)
+	c.resolver.scopes = append(c.resolver.scopes, c.scope)
+	return len(c.chunk.variables) - 1
+}
+
+// A variable that the current frame may declare
+func (c *compiler) declaration(name string) int {
+	i := c.variable(name)
+	c.chunk.variables[i].local = c.declare(name)
+	return i
+}
+
+// The slot of a variable declared in the current frame
+func (c *compiler) declare(name string) int {
+	return c.scope.layout.slot(name)
+}
+
+func (c *compiler) pushFrame(trace int) {
+	c.scope = &compileScope{layout: newScope(), parent: c.scope}
+	c.chunk.scopes = append(c.chunk.scopes, c.scope.layout)
+	c.emit(opPushFrame, trace, len(c.chunk.scopes)-1, "")
+}
+
+func (c *compiler) popFrame() {
+	c.scope = c.scope.parent
+	c.emit(opPopFrame, 0, 0, "")
+}
+
+func (c *compiler) trace(position string, description string) int {
+	return c.name(c.filename + ":" + position + ": " + description)
+}
+
+func (c *compiler) setResult() {
+	if c.result {
+		c.emit(opUndefined, 0, 0, "")
+		c.emit(opSetResult, 0, 0, "")
+	}
+}
+
+// Named functions are declared before the rest of a block runs
+func (c *compiler) block(statements []*Statement) {
+	for _, statement := range statements {
+		if funcStatement := statement.Func; funcStatement != nil {
+			c.emit(opClosure, c.closure(funcStatement.Name, funcStatement.Pos.String(),
+				funcStatement.Params, funcStatement.Block), 0, "")
+			c.emit(opDeclare, c.declare(funcStatement.Name), 0, "")
+		}
+	}
+	for _, statement := range statements {
+		c.statement(statement)
+	}
+}
+
+func (c *compiler) closure(name string, position string, params []*Param, statements []*Statement) int {
+	c.chunk.functions = append(c.chunk.functions, &functionTemplate{
+		name:       name,
+		position:   position,
+		parameters: paramNames(params),
+		types:      paramTypes(params),
+		statements: statements,
+		generator:  containsYield(statements),
+		code:       c.function(paramNames(params), statements),
+	})
+	return len(c.chunk.functions) - 1
+}
+
+func (c *compiler) statement(statement *Statement) {
+	position := statement.Pos.String()
+	c.emit(opStep, 0, 0, position)
+	switch {
+	case statement.If != nil:
+		c.ifStatement(statement.If)
+	case statement.For != nil:
+		c.forStatement(statement.For)
+	case statement.While != nil:
+		whileStatement := statement.While
+		c.loop(whileStatement.Pos.String(), whileStatement.Label, c.trace(whileStatement.Pos.String(), "while loop"),
+			nil, whileStatement.Condition, nil, whileStatement.Block)
+	case statement.Class != nil:
+		c.class(statement.Class)
+		c.setResult()
+	case statement.Func != nil:
+		// Already declared by `block`
+		c.setResult()
+	case statement.Return != nil:
+		c.returnStatement(statement.Return, position)
+	case statement.Break != nil:
+		c.jumpOut(opBreak, opBreakError, statement.Break.Label, position)
+	case statement.Continue != nil:
+		c.jumpOut(opContinue, opContinueError, statement.Continue.Label, position)
+	case statement.Yield != nil:
+		if statement.Yield.Expr != nil {
+			c.expr(statement.Yield.Expr)
+		} else {
+			c.emit(opUndefined, 0, 0, "")
+		}
+		c.emit(opYield, 0, 0, position)
+		c.statementValue()
+	case statement.Expr != nil:
+		// A lone variable isn't looked up unless it's the program's result
+		if name := statement.Expr.Assignment.identifier(); name != nil {
+			if c.result {
+				c.emit(opIdentifier, c.name(*name), 0, "")
+				c.emit(opSetResult, 0, 0, "")
+			}
+			return
+		}
+		c.assignment(statement.Expr.Assignment)
+		c.statementValue()
+	default:
+		panic("unreachable")
+	}
+}
+
+func (c *compiler) statementValue() {
+	if c.result {
+		c.emit(opSetResult, 0, 0, "")
+	} else {
+		c.emit(opPop, 0, 0, "")
+	}
+}
+
+func (c *compiler) returnStatement(returnStatement *ReturnStatement, position string) {
+	if returnStatement.Expr == nil {
+		c.emit(opUndefined, 0, 0, "")
+	} else if call := returnStatement.tailCallee(); call != nil && c.inFunction {
+		c.emit(opGetVar, c.variable(*call.Ident), 0, "")
+		for _, expr := range call.CallChain.Args.Exprs {
+			c.expr(expr)
+		}
+		c.emit(opTailCall, len(call.CallChain.Args.Exprs), 0, call.CallChain.Pos.String())
+		return
+	} else {
+		c.expr(returnStatement.Expr)
+	}
+	if c.inFunction {
+		c.emit(opReturn, 0, 0, "")
+	} else {
+		c.emit(opReturnOutside, 0, 0, position)
+	}
+}
+
+// Statically resolve a break or continue to one of the loops being compiled
+func (c *compiler) jumpOut(op opcode, errorOp opcode, label *string, position string) {
+	target := ""
+	if label != nil {
+		target = *label
+	}
+	for i := len(c.loops) - 1; i >= 0; i-- {
+		if isLoopTarget(c.loops[i], target) {
+			c.emit(op, len(c.loops)-1-i, 0, position)
+			return
+		}
+	}
+	if label != nil {
+		c.emit(errorOp, c.name(*label), 0, position)
+	} else {
+		c.emit(errorOp, -1, 0, position)
+	}
+}
+
+func (c *compiler) ifStatement(ifStatement *IfStatement) {
+	c.pushFrame(c.trace(ifStatement.Pos.String(), "if statement"))
+	c.expr(ifStatement.Condition)
+	toElse := c.emit(opIf, 0, 0, ifStatement.Condition.Pos.String())
+	c.setResult()
+	c.block(ifStatement.If)
+	toEnd := c.emit(opJump, 0, 0, "")
+	c.patch(toElse)
+	c.setResult()
+	c.block(ifStatement.Else)
+	c.patch(toEnd)
+	c.popFrame()
+}
+
+func (c *compiler) forStatement(forStatement *ForStatement) {
+	position := forStatement.Pos.String()
+	trace := c.trace(position, "for loop")
+	if forStatement.ForIn == nil {
+		c.loop(position, forStatement.Label, trace, forStatement.Init, forStatement.Condition, forStatement.Post, forStatement.Block)
+		return
+	}
+
+	forIn := forStatement.ForIn
+	c.pushFrame(trace)
+	c.expr(forIn.Iterable)
+	c.emit(opIterate, 0, 0, forIn.Iterable.Pos.String())
+	pushLoop := c.emit(opPushLoop, 0, 0, "")
+	next := c.emit(opNext, 0, 0, "")
+	c.emit(opStep, 0, 0, position)
+	c.bindForIn(forIn, next)
+	c.loopBody(forStatement.Label, forStatement.Block)
+	c.emit(opJump, next, 0, "")
+	c.patch(next)
+	c.patch(pushLoop)
+	c.chunk.code[pushLoop].b = next
+	c.emit(opPopLoop, 0, 0, "")
+	c.emit(opEndIterate, 0, 0, forIn.Iterable.Pos.String())
+	c.popFrame()
+	c.setResult()
+}
+
+// Declare the loop variables after `opNext`
+func (c *compiler) bindForIn(forIn *ForIn, next int) {
+	if forIn.Value != nil {
+		c.chunk.code[next].b = 2
+		c.emit(opDeclare, c.declare(*forIn.Value), 0, "")
+	}
+	c.emit(opDeclare, c.declare(*forIn.Key), 0, "")
+}
+
+func (c *compiler) loop(position string, label *string, trace int, init *Expr, condition *Expr, post *Expr, block []*Statement) {
+	c.pushFrame(trace)
+	if init != nil {
+		c.discard(init)
+	}
+	pushLoop := c.emit(opPushLoop, 0, 0, "")
+	start := c.emit(opStep, 0, 0, position)
+	exit := -1
+	// Having no condition is fine, assume truthy
+	if condition != nil {
+		c.expr(condition)
+		exit = c.emit(opLoopCondition, 0, 0, condition.Pos.String())
+	}
+	c.loopBody(label, block)
+	c.chunk.code[pushLoop].b = len(c.chunk.code)
+	if post != nil {
+		c.discard(post)
+	}
+	c.emit(opJump, start, 0, "")
+	if exit != -1 {
+		c.patch(exit)
+	}
+	c.patch(pushLoop)
+	c.emit(opPopLoop, 0, 0, "")
+	c.popFrame()
+	c.setResult()
+}
+
+func (c *compiler) loopBody(label *string, block []*Statement) {
+	result := c.result
+	c.result = false
+	c.loops = append(c.loops, label)
+	c.block(block)
+	c.loops = c.loops[:len(c.loops)-1]
+	c.result = result
+}
+
+func (c *compiler) class(classStatement *ClassStatement) {
+	// Every member of an instance is evaluated in the same frame
+	scope := &compileScope{layout: newScope(), parent: c.scope}
+	template := &classTemplate{name: classStatement.Name, members: classStatement.Members, scope: scope.layout}
+	for _, member := range classStatement.Members {
+		memberCompiler := c.nested(scope)
+		memberCompiler.value(member.Value, member.Pos.String())
+		memberCompiler.emit(opReturn, 0, 0, "")
+		template.code = append(template.code, memberCompiler.chunk)
+	}
+	c.chunk.classes = append(c.chunk.classes, template)
+	c.emit(opClass, len(c.chunk.classes)-1, c.declare(classStatement.Name), "")
+}
+
+// Compile an expression for its value
+func (c *compiler) expr(expr *Expr) {
+	c.assignment(expr.Assignment)
+}
+
+// The same, but a lone variable that isn't declared is reported at position
+func (c *compiler) value(expr *Expr, position string) {
+	if name := expr.Assignment.identifier(); name != nil {
+		c.emit(opGetVar, c.variable(*name), 0, position)
+		return
+	}
+	c.assignment(expr.Assignment)
+}
+
+// Compile an expression for its side effects
+func (c *compiler) discard(expr *Expr) {
+	if expr.Assignment.identifier() != nil {
+		return
+	}
+	c.assignment(expr.Assignment)
+	c.emit(opPop, 0, 0, "")
+}
+
+func (c *compiler) assignment(assignment *Assignment) {
+	target := assignment.target()
+	targetPosition := target.Pos.String()
+	isConst := assignment.Let != nil && *assignment.Let == "const"
+	if assignment.Op == nil {
+		if isConst {
+			c.emit(opError, c.name("constants need a value"), 0, targetPosition)
+			return
+		}
+		c.ternary(target)
+		if target.mayReference() {
+			c.emit(opUnref, 0, 0, "")
+		}
+		return
+	}
+
+	primary := target.primary()
+	var name *string
+	if primary != nil {
+		name = primary.identifier()
+	}
+	if name == nil {
+		c.ternary(target)
+		c.assignment(assignment.Next)
+		c.emit(opStoreRef, 0, 0, targetPosition)
+		return
+	}
+	c.assignment(assignment.Next)
+	if isConst {
+		c.emit(opConst, c.declaration(*name), c.name(assignment.Pos.String()), targetPosition)
+	} else if assignment.Let != nil {
+		c.emit(opLet, c.declaration(*name), 0, targetPosition)
+	} else {
+		c.emit(opAssign, c.variable(*name), 0, targetPosition)
+	}
+}
+
+func (c *compiler) ternary(ternary *Ternary) {
+	c.nullish(ternary.Nullish)
+	if ternary.Op == nil {
+		return
+	}
+	toElse := c.emit(opTernary, 0, 0, ternary.Nullish.Pos.String())
+	c.ternary(ternary.Then)
+	toEnd := c.emit(opJump, 0, 0, "")
+	c.patch(toElse)
+	c.ternary(ternary.Else)
+	c.patch(toEnd)
+}
+
+func (c *compiler) nullish(nullish *Nullish) {
+	c.pipeline(nullish.Pipeline)
+	if nullish.Op == nil {
+		return
+	}
+	toEnd := c.emit(opNullish, 0, 0, "")
+	c.nullish(nullish.Next)
+	c.patch(toEnd)
+}
+
+func (c *compiler) pipeline(pipeline *Pipeline) {
+	c.logicOr(pipeline.LogicOr)
+	for _, stage := range pipeline.Stages {
+		c.emit(opUnref, 0, 0, "")
+		if callChain := stage.callChain(); callChain != nil && callChain.endsWithCall() {
+			if stage.Call != nil {
+				c.emit(opGetVar, c.variable(*stage.Call.Ident), 0, stage.Pos.String())
+			} else if stage.SubExpression != nil {
+				c.value(stage.SubExpression.Expr, callChain.Pos.String())
+			} else {
+				c.operand(stage, callChain.Pos.String())
+			}
+			c.callChain(callChain, true)
+			continue
+		}
+		c.primary(stage, stage.Pos.String())
+		c.emit(opPipe, 0, 0, stage.Pos.String())
+	}
+}
+
+func (c *compiler) binary(family int, op string, position string) {
+	switch {
+	case op == "+" && family == familyAddition:
+		c.emit(opAdd, 0, 0, position)
+	case op == "-" && family == familyAddition:
+		c.emit(opSubtract, 0, 0, position)
+	case op == "*" && family == familyMultiplication:
+		c.emit(opMultiply, 0, 0, position)
+	case family == familyComparison && op == "<":
+		c.emit(opLess, 0, 0, position)
+	case family == familyComparison && op == "<=":
+		c.emit(opLessEqual, 0, 0, position)
+	case family == familyComparison && op == ">":
+		c.emit(opGreater, 0, 0, position)
+	case family == familyComparison && op == ">=":
+		c.emit(opGreaterEqual, 0, 0, position)
+	case family == familyEquality && op == "==":
+		c.emit(opEqual, 0, 0, position)
+	case family == familyEquality && op == "!=":
+		c.emit(opNotEqual, 0, 0, position)
+	default:
+		c.emit(opBinary, family, c.name(op), position)
+	}
+}
+
+func (c *compiler) logicOr(logicOr *LogicOr) {
+	c.logicAnd(logicOr.LogicAnd)
+	if logicOr.Op != nil {
+		c.logicOr(logicOr.Next)
+		c.binary(familyLogic, *logicOr.Op, logicOr.Pos.String())
+	}
+}
+
+func (c *compiler) logicAnd(logicAnd *LogicAnd) {
+	c.equality(logicAnd.Equality)
+	if logicAnd.Op != nil {
+		c.logicAnd(logicAnd.Next)
+		c.binary(familyLogic, *logicAnd.Op, logicAnd.Pos.String())
+	}
+}
+
+func (c *compiler) equality(equality *Equality) {
+	c.comparison(equality.Comparison)
+	if equality.Op != nil {
+		c.equality(equality.Next)
+		c.binary(familyEquality, *equality.Op, equality.Pos.String())
+	}
+}
+
+func (c *compiler) comparison(comparison *Comparison) {
+	c.bitwiseOr(comparison.BitwiseOr)
+	if comparison.Op != nil {
+		c.comparison(comparison.Next)
+		c.binary(familyComparison, *comparison.Op, comparison.BitwiseOr.Pos.String())
+	}
+}
+
+func (c *compiler) bitwiseOr(bitwiseOr *BitwiseOr) {
+	c.bitwiseXor(bitwiseOr.BitwiseXor)
+	for _, op := range bitwiseOr.Ops {
+		c.bitwiseXor(op.Next)
+		c.binary(familyBitwiseOr, op.Op, bitwiseOr.BitwiseXor.Pos.String())
+	}
+}
+
+func (c *compiler) bitwiseXor(bitwiseXor *BitwiseXor) {
+	c.bitwiseAnd(bitwiseXor.BitwiseAnd)
+	for _, op := range bitwiseXor.Ops {
+		c.bitwiseAnd(op.Next)
+		c.binary(familyInteger, op.Op, bitwiseXor.BitwiseAnd.Pos.String())
+	}
+}
+
+func (c *compiler) bitwiseAnd(bitwiseAnd *BitwiseAnd) {
+	c.shift(bitwiseAnd.Shift)
+	for _, op := range bitwiseAnd.Ops {
+		c.shift(op.Next)
+		c.binary(familyInteger, op.Op, bitwiseAnd.Shift.Pos.String())
+	}
+}
+
+func (c *compiler) shift(shift *Shift) {
+	c.addition(shift.Addition)
+	for _, op := range shift.Ops {
+		c.addition(op.Next)
+		c.binary(familyInteger, op.Op, shift.Addition.Pos.String())
+	}
+}
+
+func (c *compiler) addition(addition *Addition) {
+	c.multiplication(addition.Multiplication)
+	for _, op := range addition.Ops {
+		c.multiplication(op.Next)
+		c.binary(familyAddition, op.Op, addition.Multiplication.Pos.String())
+	}
+}
+
+func (c *compiler) multiplication(multiplication *Multiplication) {
+	c.unary(multiplication.Unary)
+	for _, op := range multiplication.Ops {
+		c.unary(op.Next)
+		c.binary(familyMultiplication, op.Op, multiplication.Unary.Pos.String())
+	}
+}
+
+func (c *compiler) unary(unary *Unary) {
+	if unary.Op == nil {
+		c.power(unary.Power)
+		return
+	}
+	c.unary(unary.Unary)
+	c.emit(opUnary, 0, c.name(*unary.Op), unary.Unary.Pos.String())
+}
+
+func (c *compiler) power(power *Power) {
+	c.primary(power.Primary, "")
+	if power.Op != nil {
+		c.unary(power.Next)
+		c.binary(familyPower, *power.Op, power.Primary.Pos.String())
+	}
+}
+
+// A lone variable that isn't declared is reported at position, if any
+func (c *compiler) primary(primary *Primary, position string) {
+	if primary.Call != nil {
+		c.emit(opGetVar, c.variable(*primary.Call.Ident), 0, "")
+		c.callChain(primary.Call.CallChain, false)
+		return
+	}
+	if subExpression := primary.SubExpression; subExpression != nil {
+		if subExpression.CallChain != nil {
+			c.value(subExpression.Expr, subExpression.CallChain.Pos.String())
+			c.callChain(subExpression.CallChain, false)
+			return
+		}
+		c.value(subExpression.Expr, position)
+		return
+	}
+	if primary.CallChain != nil {
+		c.operand(primary, primary.CallChain.Pos.String())
+		c.callChain(primary.CallChain, false)
+		return
+	}
+	c.operand(primary, position)
+}
+
+// Compile a primary without its trailing call chain
+func (c *compiler) operand(primary *Primary, position string) {
+	switch {
+	case primary.value != nil:
+		c.emit(opConstant, c.constant(primary.value), 0, "")
+	case primary.FuncLiteral != nil:
+		funcLiteral := primary.FuncLiteral
+		c.emit(opClosure, c.closure("", funcLiteral.Pos.String(), funcLiteral.Params, funcLiteral.Block), 0, "")
+	case primary.ListLiteral != nil:
+		c.listLiteral(primary.ListLiteral)
+	case primary.DictLiteral != nil:
+		c.dictLiteral(primary.DictLiteral)
+	case primary.Call != nil:
+		c.emit(opGetVar, c.variable(*primary.Call.Ident), 0, "")
+		c.callChain(primary.Call.CallChain, false)
+	case primary.SubExpression != nil:
+		c.value(primary.SubExpression.Expr, position)
+		if primary.SubExpression.CallChain != nil {
+			c.callChain(primary.SubExpression.CallChain, false)
+		}
+	case primary.Number != nil:
+		c.emit(opConstant, c.constant(NumberValue{val: float64(*primary.Number)}), 0, "")
+	case primary.Str != nil:
+		c.emit(opConstant, c.constant(StringValue{val: []byte(*primary.Str)[1 : len(*primary.Str)-1]}), 0, "")
+	case primary.True != nil:
+		c.emit(opConstant, c.constant(BoolValue{val: true}), 0, "")
+	case primary.False != nil:
+		c.emit(opConstant, c.constant(BoolValue{val: false}), 0, "")
+	case primary.Undefined != nil:
+		c.emit(opUndefined, 0, 0, "")
+	case primary.Ident != nil:
+		c.emit(opGetVar, c.variable(*primary.Ident), 0, position)
+	default:
+		panic("unreachable")
+	}
+}
+
+// `piped` is the value below the chain's value, it's the first argument of
+// the chain's final call
+func (c *compiler) callChain(callChain *CallChain, piped bool) {
+	shortCircuits := make([]int, 0)
+	for link := callChain; link != nil; link = link.Next {
+		optional := link.isOptional()
+		if optional {
+			shortCircuits = append(shortCircuits, c.emit(opOptional, 0, 0, ""))
+		}
+		switch {
+		case link.Index != nil:
+			c.expr(link.Index.Expr)
+			flag := 0
+			if optional {
+				flag = 1
+			}
+			c.emit(opIndex, flag, c.name(link.Index.Expr.Pos.String()), link.Pos.String())
+		case link.Property != nil:
+			flags := 0
+			if optional {
+				flags |= propertyOptional
+			}
+			if link.Next != nil && link.Next.Args != nil {
+				flags |= propertyCalled
+			}
+			c.emit(opProperty, c.name(*link.Property.Ident), flags, link.Pos.String())
+		case link.Args != nil:
+			for _, expr := range link.Args.Exprs {
+				c.expr(expr)
+			}
+			if piped && link.Next == nil {
+				c.emit(opCallPiped, len(link.Args.Exprs), 0, link.Pos.String())
+			} else {
+				c.emit(opCall, len(link.Args.Exprs), 0, link.Pos.String())
+			}
+		}
+	}
+	if len(shortCircuits) == 0 {
+		return
+	}
+	if !piped {
+		for _, jump := range shortCircuits {
+			c.patch(jump)
+		}
+		return
+	}
+	// The piped value wasn't used
+	toEnd := c.emit(opJump, 0, 0, "")
+	for _, jump := range shortCircuits {
+		c.patch(jump)
+	}
+	c.emit(opNip, 0, 0, "")
+	c.patch(toEnd)
+}
+
+func (c *compiler) listLiteral(listLiteral *ListLiteral) {
+	position := listLiteral.Pos.String()
+	if len(listLiteral.Clauses) == 0 {
+		for _, expr := range listLiteral.Items {
+			c.expr(expr)
+		}
+		c.emit(opList, len(listLiteral.Items), 0, position)
+		return
+	}
+	if len(listLiteral.Items) != 1 {
+		c.emit(opError, c.name("list comprehensions take a single item expression"), 0, position)
+		return
+	}
+	c.pushFrame(c.trace(position, "list comprehension"))
+	c.emit(opNewList, 0, 0, "")
+	c.comprehension(position, listLiteral.Clauses, func(depth int) {
+		c.expr(listLiteral.Items[0])
+		c.emit(opAppend, depth, 0, position)
+	})
+	c.popFrame()
+}
+
+func (c *compiler) dictLiteral(dictLiteral *DictLiteral) {
+	position := dictLiteral.Pos.String()
+	if len(dictLiteral.Clauses) == 0 {
+		c.emit(opNewDict, 0, 0, "")
+		for _, dictKV := range dictLiteral.Items {
+			c.dictKV(position, dictKV, 0)
+		}
+		return
+	}
+	if len(dictLiteral.Items) != 1 {
+		c.emit(opError, c.name("dictionary comprehensions take a single key-value expression"), 0, position)
+		return
+	}
+	c.pushFrame(c.trace(position, "dictionary comprehension"))
+	c.emit(opNewDict, 0, 0, "")
+	c.comprehension(position, dictLiteral.Clauses, func(depth int) {
+		c.dictKV(position, dictLiteral.Items[0], depth)
+	})
+	c.popFrame()
+}
+
+func (c *compiler) dictKV(position string, dictKV *DictKV, depth int) {
+	if dictKV.KeyExpr != nil {
+		c.expr(dictKV.KeyExpr)
+	} else {
+		c.emit(opConstant, c.constant(StringValue{val: []byte(*dictKV.KeyStr)}), 0, "")
+	}
+	c.expr(dictKV.ValueExpr)
+	c.emit(opDictItem, depth, 0, position)
+}
+
+// Nest a loop for each `for` clause. `emit` compiles the comprehension's item,
+// the list or dict being built is `depth` iterators below it
+func (c *compiler) comprehension(position string, clauses []*ComprehensionClause, emit func(depth int)) {
+	if clauses[0].For == nil {
+		c.emit(opError, c.name("comprehensions should start with a for clause"), 0, position)
+		return
+	}
+	c.comprehensionClauses(clauses, 0, emit)
+}
+
+func (c *compiler) comprehensionClauses(clauses []*ComprehensionClause, depth int, emit func(depth int)) {
+	if len(clauses) == 0 {
+		emit(depth)
+		return
+	}
+	clause := clauses[0]
+	if clause.Condition != nil {
+		c.expr(clause.Condition)
+		skip := c.emit(opTernary, 0, 0, clause.Condition.Pos.String())
+		c.comprehensionClauses(clauses[1:], depth, emit)
+		c.patch(skip)
+		return
+	}
+	c.expr(clause.For.Iterable)
+	c.emit(opIterate, 0, 0, clause.For.Iterable.Pos.String())
+	next := c.emit(opNext, 0, 0, "")
+	c.emit(opStep, 0, 0, clause.Pos.String())
+	c.bindForIn(clause.For, next)
+	c.comprehensionClauses(clauses[1:], depth+1, emit)
+	c.emit(opJump, next, 0, "")
+	c.patch(next)
+	c.emit(opPop, 0, 0, "")
+}
+
+// The variable an expression consists of e.g. `x` or `(x)`
+func (assignment *Assignment) identifier() *string {
+	if assignment.Op != nil {
+		return nil
+	}
+	if assignment.Let != nil && *assignment.Let == "const" {
+		return nil
+	}
+	primary := assignment.target().primary()
+	if primary == nil {
+		return nil
+	}
+	return primary.identifier()
+}
+
+func (primary *Primary) identifier() *string {
+	if primary.Ident != nil && primary.CallChain == nil {
+		return primary.Ident
+	}
+	if primary.SubExpression != nil && primary.SubExpression.CallChain == nil {
+		return primary.SubExpression.Expr.Assignment.identifier()
+	}
+	return nil
+}
+
+// Whether an expression may evaluate to a reference to a list item or dict key
+func (ternary *Ternary) mayReference() bool {
+	primary := ternary.primary()
+	if primary == nil {
+		return ternary.Op != nil || ternary.Nullish.Op != nil || len(ternary.Nullish.Pipeline.Stages) > 0
+	}
+	return primary.callChain() != nil || primary.SubExpression != nil
+}
+
+// The call of `return f(x)`, which can be run by the caller
+func (returnStatement ReturnStatement) tailCallee() *Call {
+	primary := returnStatement.Expr.Assignment.primary()
+	if primary == nil || primary.Call == nil {
+		return nil
+	}
+	callChain := primary.Call.CallChain
+	if callChain.Args == nil || callChain.Args.Optional != nil || callChain.Next != nil {
+		return nil
+	}
+	return primary.Call
+}
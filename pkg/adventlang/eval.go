@@ -1,6 +1,8 @@
 package adventlang
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"strconv"
@@ -10,8 +12,16 @@ import (
 type StackFrame struct {
 	filename string
 	trace    string
-	entries  map[string]Value
-	parent   *StackFrame
+	// Variables are kept in slots which the scope names. Empty slots
+	// are variables that haven't been declared (yet)
+	scope     *scope
+	slots     []Value
+	parent    *StackFrame
+	generator *generatorState
+	// Shared by every frame of a program and the modules it imports
+	runtime *runtimeState
+	// Names declared with `const` and where they were declared
+	constants map[string]string
 }
 
 func traceError(frame *StackFrame, position string, message string) error {
@@ -25,7 +35,7 @@ func traceError(frame *StackFrame, position string, message string) error {
 			break
 		}
 	}
-	return fmt.Errorf(s)
+	return errors.New(s)
 }
 
 type Context struct {
@@ -36,15 +46,65 @@ func (context *Context) Init(filename string) {
 	context.stackFrame = StackFrame{
 		filename: filename,
 		trace:    "",
-		entries:  make(map[string]Value),
+		scope:    newScope(),
+		runtime:  newRuntimeState(Options{}),
 	}
 }
 
+// The names of a frame's variables and their slots. The compiler lays
+// out each block's scope ahead of time, the tree-walker's frames and
+// a program's top-level frame add names as variables are declared
+type scope struct {
+	names []string
+	index map[string]int
+}
+
+func newScope() *scope {
+	return &scope{index: make(map[string]int)}
+}
+
+func (scope *scope) slot(name string) int {
+	if i, ok := scope.index[name]; ok {
+		return i
+	}
+	scope.names = append(scope.names, name)
+	scope.index[name] = len(scope.names) - 1
+	return len(scope.names) - 1
+}
+
+// A variable declared in this frame, nil if there isn't one
+func (frame *StackFrame) local(key string) *Value {
+	if i, ok := frame.scope.index[key]; ok && i < len(frame.slots) && frame.slots[i] != nil {
+		return &frame.slots[i]
+	}
+	return nil
+}
+
+// Declare a variable in this frame
+func (frame *StackFrame) declare(key string, value Value) {
+	i := frame.scope.slot(key)
+	for len(frame.slots) <= i {
+		frame.slots = append(frame.slots, nil)
+	}
+	frame.slots[i] = value
+}
+
+// The variables declared in this frame by name
+func (frame *StackFrame) variables() map[string]Value {
+	variables := make(map[string]Value)
+	for i, value := range frame.slots {
+		if value != nil {
+			variables[frame.scope.names[i]] = value
+		}
+	}
+	return variables
+}
+
 func (frame *StackFrame) String() string {
 	s := ""
 	for {
 		s += "{\n"
-		for key, value := range frame.entries {
+		for key, value := range frame.variables() {
 			s += fmt.Sprintf("\t %v: %v\n", key, value)
 		}
 		s += "}"
@@ -62,17 +122,29 @@ func (frame *StackFrame) GetChild(trace string) *StackFrame {
 		filename: frame.filename,
 		trace:    trace,
 		parent:   frame,
-		entries:  make(map[string]Value),
+		scope:    newScope(),
+		runtime:  frame.runtime,
 	}
 	return &childFrame
 }
 
+// A child frame with a scope that's laid out by the compiler
+func (frame *StackFrame) child(trace string, scope *scope) *StackFrame {
+	return &StackFrame{
+		filename: frame.filename,
+		trace:    trace,
+		parent:   frame,
+		scope:    scope,
+		slots:    make([]Value, len(scope.names)),
+		runtime:  frame.runtime,
+	}
+}
+
 // Get a variable's value by looking through every scope (bottom to top)
 func (frame *StackFrame) Get(key string) (Value, error) {
 	for {
-		value, ok := frame.entries[key]
-		if ok {
-			return value, nil
+		if value := frame.local(key); value != nil {
+			return *value, nil
 		}
 		if parent := frame.parent; parent != nil {
 			frame = parent
@@ -83,15 +155,30 @@ func (frame *StackFrame) Get(key string) (Value, error) {
 	return nil, fmt.Errorf("variable not declared: %v", key)
 }
 
+// Whether the scope that a variable resolves to declared it with `const`
+func (frame *StackFrame) isConstant(key string) bool {
+	for {
+		if frame.local(key) != nil {
+			_, okConst := frame.constants[key]
+			return okConst
+		}
+		if parent := frame.parent; parent != nil {
+			frame = parent
+		} else {
+			break
+		}
+	}
+	return false
+}
+
 // Set a variable by looking through every scope (bottom to top)
 // until an existing variable is found. If there is no matching
 // variable, declare a new variable in the current scope
 func (frame *StackFrame) Set(key string, value Value) {
 	currentFrame := frame
 	for {
-		_, ok := frame.entries[key]
-		if ok {
-			frame.entries[key] = value
+		if variable := frame.local(key); variable != nil {
+			*variable = value
 			return
 		}
 		if parent := frame.parent; parent != nil {
@@ -100,7 +187,7 @@ func (frame *StackFrame) Set(key string, value Value) {
 			break
 		}
 	}
-	currentFrame.entries[key] = value
+	currentFrame.declare(key, value)
 }
 
 // Language value
@@ -114,6 +201,8 @@ type Value interface {
 // so that it can be reassigned. Use `unref` to turn into a plain value
 type ReferenceValue struct {
 	val *Value
+	// Items of frozen lists and dicts can't be reassigned
+	frozen bool
 }
 
 func (referenceValue ReferenceValue) String() string {
@@ -127,11 +216,36 @@ func (referenceValue ReferenceValue) Equals(other Value) (bool, error) {
 // Get a reference's internal value
 func unref(value Value) Value {
 	if refValue, okRef := value.(ReferenceValue); okRef {
-		return *refValue.val
+		return itemOf(refValue.frozen, *refValue.val)
 	}
 	return value
 }
 
+// Lists and dicts read from a frozen value are frozen too. They're views of
+// the same items, e.g. a module's exports can't be changed by importers but
+// the module can still change them
+func itemOf(frozen bool, item Value) Value {
+	if !frozen {
+		return item
+	}
+	switch typedValue := item.(type) {
+	case ListValue:
+		if !typedValue.isFrozen() {
+			typedValue.frozen = &frozenView
+		}
+		return typedValue
+	case DictValue:
+		if !typedValue.isFrozen() {
+			typedValue.frozen = &frozenView
+		}
+		return typedValue
+	}
+	return item
+}
+
+// Shared by every view, it's never unset
+var frozenView = true
+
 // Turn an identifier into its resolution
 func unwrap(value Value, frame *StackFrame) (Value, error) {
 	// TODO: I'm not sure if this function can ever error
@@ -154,21 +268,49 @@ func (r ReturnError) Error() string {
 type BreakError struct {
 	// TODO: Use this in traces
 	position string
+	label    string
 }
 
 func (b BreakError) Error() string {
+	if b.label != "" {
+		return "break statement used with unknown label: " + b.label
+	}
 	return "break statement used outside of a loop"
 }
 
 type ContinueError struct {
 	// TODO: Use this in traces
 	position string
+	label    string
 }
 
 func (c ContinueError) Error() string {
+	if c.label != "" {
+		return "continue statement used with unknown label: " + c.label
+	}
 	return "continue statement used outside of a loop"
 }
 
+// Whether an error is a break, continue, or return rather than a failure
+func isControlFlow(err error) bool {
+	switch err.(type) {
+	case BreakError, ContinueError, ReturnError:
+		return true
+	}
+	return false
+}
+
+// Labeled breaks and continues can't escape a function or program
+func checkLabel(frame *StackFrame, err error) error {
+	if breakErr, okBreak := err.(BreakError); okBreak && breakErr.label != "" {
+		return traceError(frame, breakErr.position, breakErr.Error())
+	}
+	if contErr, okCont := err.(ContinueError); okCont && contErr.label != "" {
+		return traceError(frame, contErr.position, contErr.Error())
+	}
+	return err
+}
+
 type UndefinedValue struct{}
 
 func (undefinedValue UndefinedValue) String() string {
@@ -269,14 +411,26 @@ func (boolValue BoolValue) Equals(other Value) (bool, error) {
 }
 
 type FunctionValue struct {
+	// Empty for function literals
+	name       string
 	position   string
 	parameters []string
+	// Annotated parameter types, nil when there are none
+	types      []*TypeExpr
 	frame      *StackFrame
 	statements []*Statement
+	generator  bool
+	// The instance a method is bound to, if any
+	self Value
+	// The compiled body, nil when running on the tree-walker
+	code *chunk
 }
 
 func (functionValue FunctionValue) String() string {
 	// TODO: stringify function body?
+	if functionValue.name != "" {
+		return "function " + functionValue.name + "(" + strings.Join(functionValue.parameters, ",") + ") "
+	}
 	return "function (" + strings.Join(functionValue.parameters, ",") + ") "
 }
 
@@ -285,15 +439,129 @@ func (functionValue FunctionValue) Equals(other Value) (bool, error) {
 }
 
 func (functionValue FunctionValue) Exec(position string, args []Value) (Value, error) {
-	callFrame := functionValue.frame.GetChild(functionValue.frame.filename + ":" + position + ": function call")
+	runtime := functionValue.frame.runtime
+	if runtime.depth >= runtime.maxDepth {
+		return nil, traceError(functionValue.frame.GetChild(functionValue.trace(position)), position,
+			"maximum recursion depth exceeded")
+	}
+	runtime.depth++
+	defer func() { runtime.depth-- }()
+
+	for {
+		if stop := runtime.cancelled(); stop != nil {
+			return nil, stop.at(functionValue.frame.GetChild(functionValue.trace(position)), position)
+		}
+		callFrame, err := functionValue.bind(position, args)
+		if err != nil {
+			return nil, err
+		}
+		if functionValue.generator {
+			// The body runs as the generator is iterated
+			body := functionValue
+			return newGenerator(callFrame, func() (Value, error) {
+				return body.run(callFrame)
+			}), nil
+		}
+		value, err := functionValue.run(callFrame)
+		tail, okTail := value.(tailCall)
+		if err != nil || !okTail {
+			return value, err
+		}
+		// Calls in tail position run here instead of growing the stack
+		functionValue, position, args = tail.function, tail.position, tail.args
+	}
+}
+
+func (functionValue FunctionValue) trace(position string) string {
+	trace := functionValue.frame.filename + ":" + position + ": function call"
+	if functionValue.name != "" {
+		trace += ": " + functionValue.name
+	}
+	return trace
+}
+
+func (functionValue FunctionValue) run(callFrame *StackFrame) (Value, error) {
+	if functionValue.code != nil {
+		return execFunction(callFrame, functionValue.code)
+	}
+	return execFunctionBody(callFrame, functionValue.statements)
+}
+
+// Create a call's frame with its parameters
+func (functionValue FunctionValue) bind(position string, args []Value) (*StackFrame, error) {
+	var callFrame *StackFrame
+	if code := functionValue.code; code != nil {
+		callFrame = functionValue.frame.child(functionValue.trace(position), code.scope)
+	} else {
+		callFrame = functionValue.frame.GetChild(functionValue.trace(position))
+	}
 	if len(args) != len(functionValue.parameters) {
 		return nil, traceError(callFrame, position,
 			fmt.Sprintf("incorrect number of arguments, wanted: %v, got: %v", len(functionValue.parameters), len(args)))
 	}
+	// Parameters are always local, even if they share a name with an outer
+	// variable or a builtin e.g. `func(list) {}`
 	for i, parameter := range functionValue.parameters {
-		callFrame.Set(parameter, args[i])
+		if functionValue.types != nil && !matchesType(args[i], functionValue.types[i]) {
+			return nil, traceError(callFrame, position,
+				fmt.Sprintf("argument %v should be of type %v, got: %v", parameter, functionValue.types[i], typeName(args[i])))
+		}
+		if functionValue.code != nil {
+			callFrame.slots[functionValue.code.parameters[i]] = args[i]
+		} else {
+			callFrame.declare(parameter, args[i])
+		}
+	}
+	if functionValue.self != nil {
+		if functionValue.code != nil {
+			callFrame.slots[functionValue.code.self] = functionValue.self
+		} else {
+			callFrame.declare("self", functionValue.self)
+		}
+	}
+	return callFrame, nil
+}
+
+// `return f(x)` returns the call for the caller's `Exec` to run
+type tailCall struct {
+	function FunctionValue
+	position string
+	args     []Value
+}
+
+func (tail tailCall) String() string {
+	return tail.function.String()
+}
+
+func (tail tailCall) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+// Only calls of user functions by name e.g. `return f(x)` are deferred
+func (returnStatement ReturnStatement) tailCall(frame *StackFrame) (*tailCall, error) {
+	call := returnStatement.tailCallee()
+	if call == nil {
+		return nil, nil
+	}
+	callChain := call.CallChain
+	value, err := frame.Get(*call.Ident)
+	if err != nil {
+		return nil, nil
+	}
+	function, okFunction := value.(FunctionValue)
+	if !okFunction || function.generator {
+		return nil, nil
+	}
+	args, err := evalExprs(frame, callChain.Args.Exprs)
+	if err != nil {
+		return nil, err
 	}
-	for _, statement := range functionValue.statements {
+	return &tailCall{function: function, position: callChain.Pos.String(), args: args}, nil
+}
+
+func execFunctionBody(callFrame *StackFrame, statements []*Statement) (Value, error) {
+	hoistFunctions(callFrame, statements)
+	for _, statement := range statements {
 		_, err := statement.Eval(callFrame)
 		if err != nil {
 			// Catch the bubbling return here
@@ -304,7 +572,7 @@ func (functionValue FunctionValue) Exec(position string, args []Value) (Value, e
 				}
 				return value, nil
 			}
-			return nil, err
+			return nil, checkLabel(callFrame, err)
 		}
 	}
 	return UndefinedValue{}, nil
@@ -312,6 +580,17 @@ func (functionValue FunctionValue) Exec(position string, args []Value) (Value, e
 
 type ListValue struct {
 	val map[int]*Value
+	// Shared by every copy of the list, so that `freeze()` changes them
+	// all. Read-only views have their own, see itemOf
+	frozen *bool
+}
+
+func newListValue(capacity int) ListValue {
+	return ListValue{val: make(map[int]*Value, capacity), frozen: new(bool)}
+}
+
+func (listValue ListValue) isFrozen() bool {
+	return listValue.frozen != nil && *listValue.frozen
 }
 
 func (listValue *ListValue) Get(index int) (Value, error) {
@@ -323,7 +602,7 @@ func (listValue *ListValue) Get(index int) (Value, error) {
 		// All values between the bounds should be valid
 		panic("unreachable")
 	}
-	return ReferenceValue{val: value}, nil
+	return ReferenceValue{val: value, frozen: listValue.isFrozen()}, nil
 }
 
 func (listValue ListValue) String() string {
@@ -369,6 +648,19 @@ func (listValue ListValue) Popat(index int) (Value, error) {
 
 type DictValue struct {
 	val map[string]*Value
+	// Set when the dict is an instance of a class
+	class *ClassValue
+	// Shared by every copy of the dict, so that `freeze()` changes them
+	// all. Read-only views have their own, see itemOf
+	frozen *bool
+}
+
+func newDictValue(capacity int) DictValue {
+	return DictValue{val: make(map[string]*Value, capacity), frozen: new(bool)}
+}
+
+func (dictValue DictValue) isFrozen() bool {
+	return dictValue.frozen != nil && *dictValue.frozen
 }
 
 func (dictValue *DictValue) Get(key string) (*Value, error) {
@@ -384,6 +676,16 @@ func (dictValue *DictValue) Set(key string, value Value) *Value {
 	return &value
 }
 
+// A reference to a missing key, which is added to the dict so that it can be
+// assigned to. Frozen dicts aren't changed
+func (dictValue *DictValue) missing(key string) ReferenceValue {
+	if dictValue.isFrozen() {
+		var undefined Value = UndefinedValue{}
+		return ReferenceValue{val: &undefined, frozen: true}
+	}
+	return ReferenceValue{val: dictValue.Set(key, UndefinedValue{})}
+}
+
 func (dictValue *DictValue) Delete(key string) {
 	delete(dictValue.val, key)
 }
@@ -393,6 +695,9 @@ func (dictValue DictValue) String() string {
 	for key, value := range dictValue.val {
 		s = append(s, fmt.Sprintf("\"%v\": %v", key, *value))
 	}
+	if dictValue.class != nil {
+		return dictValue.class.name + " {" + strings.Join(s, ", ") + "}"
+	}
 	return "{" + strings.Join(s, ", ") + "}"
 }
 
@@ -417,7 +722,7 @@ func (program Program) Equals(other Value) (bool, error) {
 func (program Program) Eval(frame *StackFrame) (Value, error) {
 	value, err := evalBlock(frame, program.Statements)
 	if err != nil {
-		return nil, err
+		return nil, checkLabel(frame, err)
 	}
 	value, err = unwrap(value, frame)
 	if err != nil {
@@ -430,6 +735,7 @@ func evalBlock(frame *StackFrame, statements []*Statement) (Value, error) {
 	var result Value
 	result = UndefinedValue{}
 	var err error
+	hoistFunctions(frame, statements)
 	for _, statement := range statements {
 		result, err = statement.Eval(frame)
 		if err != nil {
@@ -448,6 +754,9 @@ func (statement Statement) Equals(other Value) (bool, error) {
 }
 
 func (statement Statement) Eval(frame *StackFrame) (Value, error) {
+	if stop := frame.runtime.step(); stop != nil {
+		return nil, stop.at(frame, statement.Pos.String())
+	}
 	if statement.If != nil {
 		return statement.If.Eval(frame)
 	}
@@ -457,24 +766,66 @@ func (statement Statement) Eval(frame *StackFrame) (Value, error) {
 	if statement.While != nil {
 		return statement.While.Eval(frame)
 	}
+	if statement.Class != nil {
+		return statement.Class.Eval(frame)
+	}
+	if statement.Func != nil {
+		// Already declared by `hoistFunctions`
+		return UndefinedValue{}, nil
+	}
 	if statement.Return != nil {
 		// In this if block, we can escape to the nearest func
 		if statement.Return.Expr == nil {
 			return nil, ReturnError{val: UndefinedValue{}}
 		}
+		tail, err := statement.Return.tailCall(frame)
+		if err != nil {
+			return nil, err
+		}
+		if tail != nil {
+			return nil, ReturnError{val: *tail}
+		}
 		value, err := statement.Return.Expr.Eval(frame)
 		if err != nil {
 			return nil, err
 		}
+		// Resolve variables here, they may be local to a nested block
+		value, err = unwrap(value, frame)
+		if err != nil {
+			return nil, err
+		}
 		return nil, ReturnError{val: value}
 	}
 	if statement.Break != nil {
 		// Escape up to a loop (or error out)
-		return nil, BreakError{position: statement.Pos.String()}
+		breakErr := BreakError{position: statement.Pos.String()}
+		if statement.Break.Label != nil {
+			breakErr.label = *statement.Break.Label
+		}
+		return nil, breakErr
 	}
 	if statement.Continue != nil {
 		// Escape up to a loop (or error out)
-		return nil, ContinueError{position: statement.Pos.String()}
+		contErr := ContinueError{position: statement.Pos.String()}
+		if statement.Continue.Label != nil {
+			contErr.label = *statement.Continue.Label
+		}
+		return nil, contErr
+	}
+	if statement.Yield != nil {
+		var value Value = UndefinedValue{}
+		if statement.Yield.Expr != nil {
+			var err error
+			value, err = statement.Yield.Expr.Eval(frame)
+			if err != nil {
+				return nil, err
+			}
+			value, err = unwrap(value, frame)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return yieldValue(frame, statement.Pos.String(), value)
 	}
 	if statement.Expr != nil {
 		return statement.Expr.Eval(frame)
@@ -496,15 +847,27 @@ func (ifStatement IfStatement) Eval(frame *StackFrame) (Value, error) {
 	if err != nil {
 		return nil, err
 	}
+	condition, err = unwrap(condition, ifFrame)
+	if err != nil {
+		return nil, err
+	}
+	// Errors are reported from the frame that the if statement is in
+	ok, err := isTrue(frame, ifStatement.Condition.Pos.String(), condition)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return evalBlock(ifFrame, ifStatement.If)
+	}
+	return evalBlock(ifFrame, ifStatement.Else)
+}
 
+// Conditions have to be bools, there's no truthiness
+func isTrue(frame *StackFrame, position string, condition Value) (bool, error) {
 	if boolValue, okBool := condition.(BoolValue); okBool {
-		if boolValue.val {
-			return evalBlock(ifFrame, ifStatement.If)
-		}
-		return evalBlock(ifFrame, ifStatement.Else)
+		return boolValue.val, nil
 	}
-	return nil, traceError(frame, ifStatement.Condition.Pos.String(),
-		"conditional should evaluate to true or false")
+	return false, traceError(frame, position, "conditional should evaluate to true or false")
 }
 
 func (forStatement ForStatement) String() string {
@@ -517,6 +880,9 @@ func (forStatement ForStatement) Equals(other Value) (bool, error) {
 
 func (forStatement ForStatement) Eval(frame *StackFrame) (Value, error) {
 	forFrame := frame.GetChild(frame.filename + ":" + forStatement.Pos.String() + ": for loop")
+	if forStatement.ForIn != nil {
+		return evalForIn(forFrame, forStatement.Pos.String(), forStatement.Label, forStatement.ForIn, forStatement.Block)
+	}
 	// Having no init is fine
 	if forStatement.Init != nil {
 		_, err := forStatement.Init.Eval(forFrame)
@@ -524,7 +890,7 @@ func (forStatement ForStatement) Eval(frame *StackFrame) (Value, error) {
 			return nil, err
 		}
 	}
-	return evalLoop(forFrame, forStatement.Condition, forStatement.Block, forStatement.Post)
+	return evalLoop(forFrame, forStatement.Pos.String(), forStatement.Label, forStatement.Condition, forStatement.Block, forStatement.Post)
 }
 
 func (whileStatement WhileStatement) String() string {
@@ -537,7 +903,7 @@ func (whileStatement WhileStatement) Equals(other Value) (bool, error) {
 
 func (whileStatement WhileStatement) Eval(frame *StackFrame) (Value, error) {
 	whileFrame := frame.GetChild(frame.filename + ":" + whileStatement.Pos.String() + ": while loop")
-	return evalLoop(whileFrame, whileStatement.Condition, whileStatement.Block, nil)
+	return evalLoop(whileFrame, whileStatement.Pos.String(), whileStatement.Label, whileStatement.Condition, whileStatement.Block, nil)
 }
 
 func (expr Expr) String() string {
@@ -561,17 +927,16 @@ func (assignment Assignment) Equals(other Value) (bool, error) {
 }
 
 func (assignment Assignment) Eval(frame *StackFrame) (Value, error) {
-	left, err := assignment.LogicOr.Eval(frame)
+	left, err := assignment.target().Eval(frame)
 	if err != nil {
 		return nil, err
 	}
-	leftRef, leftRefOk := left.(ReferenceValue)
 
 	if assignment.Op == nil {
-		if leftRefOk {
-			return *leftRef.val, nil
+		if assignment.Let != nil && *assignment.Let == "const" {
+			return nil, traceError(frame, assignment.target().Pos.String(), "constants need a value")
 		}
-		return left, nil
+		return unref(left), nil
 	}
 
 	// assignment.Op is "="
@@ -585,23 +950,182 @@ func (assignment Assignment) Eval(frame *StackFrame) (Value, error) {
 			return nil, err
 		}
 	}
-	if leftRefOk {
+	if leftId, okId := left.(IdentifierValue); okId {
+		return assignVariable(frame, assignment.Pos.String(), assignment.target().Pos.String(), assignment.Let, leftId.val, right)
+	}
+	return assignReference(frame, assignment.target().Pos.String(), left, right)
+}
+
+// `let` declares a variable, otherwise the variable has to exist already
+func assignVariable(frame *StackFrame, position string, targetPosition string, let *string, name string, right Value) (Value, error) {
+	if let == nil {
+		_, err := frame.Get(name)
+		if err != nil {
+			return nil, traceError(frame, targetPosition,
+				"can't assign to unknown variable: "+name)
+		}
+	}
+	if let != nil && *let == "const" {
+		// Constants are declared in the current scope. A loop body
+		// may run the same declaration again
+		if declared, okConst := frame.constants[name]; okConst && declared != position {
+			return nil, traceError(frame, targetPosition,
+				"can't reassign constant: "+name)
+		}
+		if frame.constants == nil {
+			frame.constants = make(map[string]string)
+		}
+		frame.constants[name] = position
+		frame.declare(name, right)
+		return right, nil
+	}
+	if frame.isConstant(name) {
+		return nil, traceError(frame, targetPosition,
+			"can't reassign constant: "+name)
+	}
+	frame.Set(name, right)
+	return right, nil
+}
+
+// Assign to a list item or dict key
+func assignReference(frame *StackFrame, targetPosition string, left Value, right Value) (Value, error) {
+	if leftRef, okRef := left.(ReferenceValue); okRef {
+		if leftRef.frozen {
+			return nil, traceError(frame, targetPosition,
+				"can't assign to an item of a frozen value")
+		}
 		*leftRef.val = right
 		return right, nil
 	}
-	if leftId, okId := left.(IdentifierValue); okId {
-		if assignment.Let == nil {
-			_, err = frame.Get(leftId.val)
+	return nil, traceError(frame, targetPosition,
+		"can't assign to non-variable: "+left.String())
+}
+
+func (ternary Ternary) String() string {
+	return "ternary"
+}
+
+func (ternary Ternary) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (ternary Ternary) Eval(frame *StackFrame) (Value, error) {
+	condition, err := ternary.Nullish.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if ternary.Op == nil {
+		return condition, nil
+	}
+	condition, err = unwrap(condition, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the chosen branch is evaluated
+	ok, err := isTrue(frame, ternary.Nullish.Pos.String(), condition)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return ternary.Then.Eval(frame)
+	}
+	return ternary.Else.Eval(frame)
+}
+
+func (nullish Nullish) String() string {
+	return "nullish coalescing"
+}
+
+func (nullish Nullish) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (nullish Nullish) Eval(frame *StackFrame) (Value, error) {
+	left, err := nullish.Pipeline.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if nullish.Op == nil {
+		return left, nil
+	}
+	left, err = unwrap(left, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	// The right side is only evaluated when the left side is undefined
+	if _, okUndefined := left.(UndefinedValue); !okUndefined {
+		return left, nil
+	}
+	return nullish.Next.Eval(frame)
+}
+
+func (pipeline Pipeline) String() string {
+	return "pipeline"
+}
+
+func (pipeline Pipeline) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (pipeline Pipeline) Eval(frame *StackFrame) (Value, error) {
+	value, err := pipeline.LogicOr.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	for _, stage := range pipeline.Stages {
+		value, err = unwrap(value, frame)
+		if err != nil {
+			return nil, err
+		}
+		value, err = evalPipelineStage(frame, stage, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// A stage that ends in a call gets the piped value as its first argument,
+// any other stage should evaluate to a function that's called with it
+func evalPipelineStage(frame *StackFrame, stage *Primary, piped Value) (Value, error) {
+	if callChain := stage.callChain(); callChain != nil && callChain.endsWithCall() {
+		var value Value
+		var err error
+		if stage.Call != nil {
+			value, err = frame.Get(*stage.Call.Ident)
 			if err != nil {
-				return nil, traceError(frame, assignment.LogicOr.Pos.String(),
-					"can't assign to unknown variable: "+left.String())
+				return nil, traceError(frame, stage.Pos.String(), err.Error())
 			}
+		} else if stage.SubExpression != nil {
+			value, err = stage.SubExpression.Expr.Eval(frame)
+		} else {
+			value, err = stage.evalOperand(frame)
 		}
-		frame.Set(leftId.val, right)
-		return right, nil
+		if err != nil {
+			return nil, err
+		}
+		return evalCallChain(frame, value, callChain, piped)
 	}
-	return nil, traceError(frame, assignment.LogicOr.Pos.String(),
-		"can't assign to non-variable: "+left.String())
+
+	function, err := stage.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	function, err = unwrap(function, frame)
+	if err != nil {
+		return nil, traceError(frame, stage.Pos.String(), err.Error())
+	}
+	return pipeTo(frame, stage.Pos.String(), function, piped)
+}
+
+func pipeTo(frame *StackFrame, position string, function Value, piped Value) (Value, error) {
+	if !isFunction(function) {
+		return nil, traceError(frame, position,
+			"pipeline stages should be functions or calls, got: "+typeName(function))
+	}
+	return callFunction(frame, position, function, []Value{piped})
 }
 
 func (logicAnd LogicAnd) String() string {
@@ -633,14 +1157,7 @@ func (logicAnd LogicAnd) Eval(frame *StackFrame) (Value, error) {
 		return nil, err
 	}
 
-	if leftBoolValue, okLeftBool := left.(BoolValue); okLeftBool {
-		if rightBoolValue, okRightBool := right.(BoolValue); okRightBool {
-			return BoolValue{val: leftBoolValue.val && rightBoolValue.val}, nil
-		}
-	}
-	return nil, traceError(frame, logicAnd.Pos.String(),
-		"only bools can be compared with 'and', found: "+left.String()+" and "+right.String())
-
+	return evalLogic(frame, logicAnd.Pos.String(), *logicAnd.Op, left, right)
 }
 
 func (logicOr LogicOr) String() string {
@@ -672,14 +1189,21 @@ func (logicOr LogicOr) Eval(frame *StackFrame) (Value, error) {
 		return nil, err
 	}
 
+	return evalLogic(frame, logicOr.Pos.String(), *logicOr.Op, left, right)
+}
+
+// Both sides of `and` and `or` are always evaluated
+func evalLogic(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
 	if leftBoolValue, okLeftBool := left.(BoolValue); okLeftBool {
 		if rightBoolValue, okRightBool := right.(BoolValue); okRightBool {
+			if op == "and" {
+				return BoolValue{val: leftBoolValue.val && rightBoolValue.val}, nil
+			}
 			return BoolValue{val: leftBoolValue.val || rightBoolValue.val}, nil
 		}
 	}
-	return nil, traceError(frame, logicOr.Pos.String(),
-		"only bools can be compared with 'or', found: "+left.String()+" and "+right.String())
-
+	return nil, traceError(frame, position,
+		"only bools can be compared with '"+op+"', found: "+left.String()+" and "+right.String())
 }
 
 func (equality Equality) String() string {
@@ -719,15 +1243,35 @@ func (equality Equality) Eval(frame *StackFrame) (Value, error) {
 		}
 		right = value
 	}
+	return evalEquality(frame, equality.Pos.String(), *equality.Op, left, right)
+}
+
+func evalEquality(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	// Instances can define their own equality
+	if method, okMethod := getMethod(left, "equals"); okMethod {
+		result, err := callFunction(frame, position, method, []Value{right})
+		if err != nil {
+			return nil, err
+		}
+		boolValue, okBool := result.(BoolValue)
+		if !okBool {
+			return nil, traceError(frame, position,
+				"equals should return a bool, got: "+typeName(result))
+		}
+		if op == "!=" {
+			return BoolValue{val: !boolValue.val}, nil
+		}
+		return boolValue, nil
+	}
 
 	// Dicts, lists, functions are never equal
 	result, err := left.Equals(right)
 	if err != nil {
 		return nil, err
 	}
-	if *equality.Op == "==" {
+	if op == "==" {
 		return BoolValue{val: result}, nil
-	} else if *equality.Op == "!=" {
+	} else if op == "!=" {
 		return BoolValue{val: !result}, nil
 	}
 	panic("unreachable")
@@ -742,7 +1286,7 @@ func (comparison Comparison) Equals(other Value) (bool, error) {
 }
 
 func (comparison Comparison) Eval(frame *StackFrame) (Value, error) {
-	left, err := comparison.Addition.Eval(frame)
+	left, err := comparison.BitwiseOr.Eval(frame)
 	if err != nil {
 		return nil, err
 	}
@@ -763,78 +1307,400 @@ func (comparison Comparison) Eval(frame *StackFrame) (Value, error) {
 		return nil, err
 	}
 
-	if leftNum, okNum := left.(NumberValue); okNum {
+	return evalComparison(frame, comparison.BitwiseOr.Pos.String(), *comparison.Op, left, right)
+}
+
+func evalComparison(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	if leftNum, okNum := left.(NumberValue); okNum {
 		if rightNum, okNum := right.(NumberValue); okNum {
-			return BoolValue{val: *comparison.Op == "<" && leftNum.val < rightNum.val ||
-				*comparison.Op == "<=" && leftNum.val <= rightNum.val ||
-				*comparison.Op == ">" && leftNum.val > rightNum.val ||
-				*comparison.Op == ">=" && leftNum.val >= rightNum.val}, nil
+			return BoolValue{val: op == "<" && leftNum.val < rightNum.val ||
+				op == "<=" && leftNum.val <= rightNum.val ||
+				op == ">" && leftNum.val > rightNum.val ||
+				op == ">=" && leftNum.val >= rightNum.val}, nil
+		}
+	}
+
+	ordering, err := compareValues(left, right)
+	if err != nil {
+		_, okLeft := left.(ListValue)
+		_, okRight := right.(ListValue)
+		if okLeft && okRight {
+			return nil, traceError(frame, position, "'"+op+"' "+err.Error())
 		}
+		return nil, traceError(frame, position,
+			"'"+op+"' can only be used between [number, number], [string, string], [list, list], not: ["+typeName(left)+", "+typeName(right)+"]")
 	}
-	return nil, traceError(frame, comparison.Addition.Pos.String(),
-		"only numbers can be compared with "+*comparison.Op+" found: "+left.String()+" and "+right.String())
+	return BoolValue{val: op == "<" && ordering < 0 ||
+		op == "<=" && ordering <= 0 ||
+		op == ">" && ordering > 0 ||
+		op == ">=" && ordering >= 0}, nil
 }
 
-func (addition Addition) String() string {
-	return "addition"
+// Order two values: numbers, strings (byte-wise), and lists (item by item)
+func compareValues(left Value, right Value) (int, error) {
+	left = unref(left)
+	right = unref(right)
+	switch leftValue := left.(type) {
+	case NumberValue:
+		if rightNum, okNum := right.(NumberValue); okNum {
+			if leftValue.val < rightNum.val {
+				return -1, nil
+			}
+			if leftValue.val > rightNum.val {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case StringValue:
+		if rightStr, okStr := right.(StringValue); okStr {
+			return bytes.Compare(leftValue.val, rightStr.val), nil
+		}
+	case ListValue:
+		if rightList, okList := right.(ListValue); okList {
+			for i := 0; i < len(leftValue.val) && i < len(rightList.val); i++ {
+				ordering, err := compareValues(*leftValue.val[i], *rightList.val[i])
+				if err != nil {
+					return 0, err
+				}
+				if ordering != 0 {
+					return ordering, nil
+				}
+			}
+			return compareValues(NumberValue{val: float64(len(leftValue.val))}, NumberValue{val: float64(len(rightList.val))})
+		}
+	}
+	return 0, fmt.Errorf("can't compare list items of type %v and %v", typeName(left), typeName(right))
 }
 
-func (addition Addition) Equals(other Value) (bool, error) {
+// Bitwise operators and shifts only accept whole numbers
+func toInteger(value Value) (int64, bool) {
+	if numValue, okNum := value.(NumberValue); okNum {
+		// math.MaxInt64 rounds up to 2^63 as a float, which doesn't fit
+		if numValue.val == math.Trunc(numValue.val) &&
+			numValue.val >= math.MinInt64 && numValue.val < math.MaxInt64 {
+			return int64(numValue.val), true
+		}
+	}
+	return 0, false
+}
+
+func evalIntegerOp(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	leftInt, okLeft := toInteger(left)
+	rightInt, okRight := toInteger(right)
+	if !okLeft || !okRight {
+		return nil, traceError(frame, position,
+			"'"+op+"' can only be used between [integer, integer], not: ["+left.String()+", "+right.String()+"]")
+	}
+	switch op {
+	case "|":
+		return NumberValue{val: float64(leftInt | rightInt)}, nil
+	case "^":
+		return NumberValue{val: float64(leftInt ^ rightInt)}, nil
+	case "&":
+		return NumberValue{val: float64(leftInt & rightInt)}, nil
+	}
+	if rightInt < 0 {
+		return nil, traceError(frame, position,
+			"'"+op+"' can't shift by a negative amount: "+right.String())
+	}
+	if op == "<<" {
+		return NumberValue{val: float64(leftInt << uint64(rightInt))}, nil
+	}
+	if op == ">>" {
+		return NumberValue{val: float64(leftInt >> uint64(rightInt))}, nil
+	}
+	panic("unreachable")
+}
+
+func (bitwiseOr BitwiseOr) String() string {
+	return "bitwise or"
+}
+
+func (bitwiseOr BitwiseOr) Equals(other Value) (bool, error) {
 	return false, nil
 }
 
-func (addition Addition) Eval(frame *StackFrame) (Value, error) {
-	left, err := addition.Multiplication.Eval(frame)
+func (bitwiseOr BitwiseOr) Eval(frame *StackFrame) (Value, error) {
+	left, err := bitwiseOr.BitwiseXor.Eval(frame)
 	if err != nil {
 		return nil, err
 	}
-
-	if addition.Op == nil {
+	if len(bitwiseOr.Ops) == 0 {
 		return left, nil
 	}
-
-	right, err := addition.Next.Eval(frame)
+	left, err = unwrap(left, frame)
 	if err != nil {
 		return nil, err
 	}
+	for _, op := range bitwiseOr.Ops {
+		right, err := op.Next.Eval(frame)
+		if err != nil {
+			return nil, err
+		}
+		right, err = unwrap(right, frame)
+		if err != nil {
+			return nil, err
+		}
+		left, err = evalBitwiseOr(frame, bitwiseOr.BitwiseXor.Pos.String(), op.Op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func evalBitwiseOr(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	// Merge two dicts into a new dict, keys on the right win
+	leftDict, okLeft := left.(DictValue)
+	rightDict, okRight := right.(DictValue)
+	if okLeft && okRight {
+		merged := newDictValue(len(leftDict.val) + len(rightDict.val))
+		for key, value := range leftDict.val {
+			merged.Set(key, itemOf(leftDict.isFrozen(), *value))
+		}
+		for key, value := range rightDict.val {
+			merged.Set(key, itemOf(rightDict.isFrozen(), *value))
+		}
+		return merged, nil
+	}
+	if okLeft || okRight {
+		return nil, traceError(frame, position,
+			"'|' can only be used between [integer, integer], [dict, dict], not: ["+typeName(left)+", "+typeName(right)+"]")
+	}
+	return evalIntegerOp(frame, position, op, left, right)
+}
+
+func (bitwiseXor BitwiseXor) String() string {
+	return "bitwise xor"
+}
+
+func (bitwiseXor BitwiseXor) Equals(other Value) (bool, error) {
+	return false, nil
+}
 
+func (bitwiseXor BitwiseXor) Eval(frame *StackFrame) (Value, error) {
+	left, err := bitwiseXor.BitwiseAnd.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(bitwiseXor.Ops) == 0 {
+		return left, nil
+	}
 	left, err = unwrap(left, frame)
 	if err != nil {
 		return nil, err
 	}
+	for _, op := range bitwiseXor.Ops {
+		right, err := op.Next.Eval(frame)
+		if err != nil {
+			return nil, err
+		}
+		right, err = unwrap(right, frame)
+		if err != nil {
+			return nil, err
+		}
+		left, err = evalIntegerOp(frame, bitwiseXor.BitwiseAnd.Pos.String(), op.Op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
 
-	right, err = unwrap(right, frame)
+func (bitwiseAnd BitwiseAnd) String() string {
+	return "bitwise and"
+}
+
+func (bitwiseAnd BitwiseAnd) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (bitwiseAnd BitwiseAnd) Eval(frame *StackFrame) (Value, error) {
+	left, err := bitwiseAnd.Shift.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(bitwiseAnd.Ops) == 0 {
+		return left, nil
+	}
+	left, err = unwrap(left, frame)
 	if err != nil {
 		return nil, err
 	}
+	for _, op := range bitwiseAnd.Ops {
+		right, err := op.Next.Eval(frame)
+		if err != nil {
+			return nil, err
+		}
+		right, err = unwrap(right, frame)
+		if err != nil {
+			return nil, err
+		}
+		left, err = evalIntegerOp(frame, bitwiseAnd.Shift.Pos.String(), op.Op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (shift Shift) String() string {
+	return "shift"
+}
 
-	err = traceError(frame, addition.Multiplication.Pos.String(),
-		"'+' can only be used between [string, string], [number, number], not: ["+left.String()+", "+right.String()+"]")
+func (shift Shift) Equals(other Value) (bool, error) {
+	return false, nil
+}
 
-	leftStr, okLeft := left.(StringValue)
-	rightStr, okRight := right.(StringValue)
-	if *addition.Op == "+" && (okLeft && !okRight || okRight && !okLeft) {
+func (shift Shift) Eval(frame *StackFrame) (Value, error) {
+	left, err := shift.Addition.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(shift.Ops) == 0 {
+		return left, nil
+	}
+	left, err = unwrap(left, frame)
+	if err != nil {
 		return nil, err
-	} else if *addition.Op == "+" && okLeft && okRight {
-		return StringValue{val: append([]byte{}, append(leftStr.val, rightStr.val...)...)}, nil
 	}
+	for _, op := range shift.Ops {
+		right, err := op.Next.Eval(frame)
+		if err != nil {
+			return nil, err
+		}
+		right, err = unwrap(right, frame)
+		if err != nil {
+			return nil, err
+		}
+		left, err = evalIntegerOp(frame, shift.Addition.Pos.String(), op.Op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
 
-	leftNum, okLeft := left.(NumberValue)
-	rightNum, okRight := right.(NumberValue)
-	if okLeft && !okRight || okRight && !okLeft {
+func (addition Addition) String() string {
+	return "addition"
+}
+
+func (addition Addition) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (addition Addition) Eval(frame *StackFrame) (Value, error) {
+	left, err := addition.Multiplication.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(addition.Ops) == 0 {
+		return left, nil
+	}
+	left, err = unwrap(left, frame)
+	if err != nil {
 		return nil, err
 	}
-	if *addition.Op == "+" && okLeft && okRight {
-		return NumberValue{val: leftNum.val + rightNum.val}, nil
+	for _, op := range addition.Ops {
+		right, err := op.Next.Eval(frame)
+		if err != nil {
+			return nil, err
+		}
+		right, err = unwrap(right, frame)
+		if err != nil {
+			return nil, err
+		}
+		left, err = evalAddition(frame, addition.Multiplication.Pos.String(), op.Op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func evalAddition(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	if op == "+" {
+		if leftStr, okLeft := left.(StringValue); okLeft {
+			if rightStr, okRight := right.(StringValue); okRight {
+				if limit := frame.runtime.allocate(len(leftStr.val) + len(rightStr.val)); limit != nil {
+					return nil, limit.at(frame, position)
+				}
+				return StringValue{val: append([]byte{}, append(leftStr.val, rightStr.val...)...)}, nil
+			}
+		}
+		if leftList, okLeft := left.(ListValue); okLeft {
+			if rightList, okRight := right.(ListValue); okRight {
+				if limit := frame.runtime.allocate((len(leftList.val) + len(rightList.val)) * listItemSize); limit != nil {
+					return nil, limit.at(frame, position)
+				}
+				// Items are copied into a new list
+				listValue := newListValue(len(leftList.val) + len(rightList.val))
+				for i := 0; i < len(leftList.val); i++ {
+					listValue.Append(itemOf(leftList.isFrozen(), *leftList.val[i]))
+				}
+				for i := 0; i < len(rightList.val); i++ {
+					listValue.Append(itemOf(rightList.isFrozen(), *rightList.val[i]))
+				}
+				return listValue, nil
+			}
+		}
+		if leftNum, okLeft := left.(NumberValue); okLeft {
+			if rightNum, okRight := right.(NumberValue); okRight {
+				return NumberValue{val: leftNum.val + rightNum.val}, nil
+			}
+		}
+		return nil, traceError(frame, position,
+			"'+' can only be used between [string, string], [number, number], [list, list], not: ["+typeName(left)+", "+typeName(right)+"]")
+	}
+
+	if leftNum, okLeft := left.(NumberValue); okLeft {
+		if rightNum, okRight := right.(NumberValue); okRight {
+			return NumberValue{val: leftNum.val - rightNum.val}, nil
+		}
+	}
+	return nil, traceError(frame, position,
+		"'-' can only be used between [number, number], not: ["+typeName(left)+", "+typeName(right)+"]")
+}
+
+// The longest string or list that repetition can make
+const maxRepeatLength = 1 << 30
+
+func repeatValue(frame *StackFrame, position string, sequence Value, count Value) (Value, error) {
+	times, okInt := toInteger(count)
+	if !okInt || times < 0 {
+		return nil, traceError(frame, position,
+			"'*' can only repeat a "+typeName(sequence)+" a whole number of times, not: "+count.String())
+	}
+	var length, itemSize int64
+	switch typedSequence := sequence.(type) {
+	case StringValue:
+		length, itemSize = int64(len(typedSequence.val)), 1
+	case ListValue:
+		length, itemSize = int64(len(typedSequence.val)), listItemSize
+	}
+	// Counted before the length is checked, so programs with a memory
+	// limit fail with a LimitError
+	if limit := frame.runtime.allocateItems(length, times, itemSize); limit != nil {
+		return nil, limit.at(frame, position)
 	}
-	if *addition.Op == "-" && okLeft && okRight {
-		return NumberValue{val: leftNum.val - rightNum.val}, nil
+	if length > 0 && times > maxRepeatLength/length {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("'*' would make a %v that's too long, length: %v, times: %v", typeName(sequence), length, count))
 	}
-	if *addition.Op == "-" {
-		return nil, traceError(frame, addition.Multiplication.Pos.String(),
-			"'-' and '+' can only be used between [number, number], not: ["+left.String()+", "+right.String()+"]")
+	if length == 0 {
+		times = 0
 	}
-	return nil, err
+	if strValue, okStr := sequence.(StringValue); okStr {
+		return StringValue{val: bytes.Repeat(strValue.val, int(times))}, nil
+	}
+	listValue := sequence.(ListValue)
+	repeated := newListValue(len(listValue.val) * int(times))
+	for i := int64(0); i < times; i++ {
+		for j := 0; j < len(listValue.val); j++ {
+			repeated.Append(itemOf(listValue.isFrozen(), *listValue.val[j]))
+		}
+	}
+	return repeated, nil
 }
 
 func (multiplication Multiplication) String() string {
@@ -850,90 +1716,196 @@ func (multiplication Multiplication) Eval(frame *StackFrame) (Value, error) {
 	if err != nil {
 		return nil, err
 	}
-	if multiplication.Op == nil {
+	if len(multiplication.Ops) == 0 {
 		return left, nil
 	}
-	right, err := multiplication.Next.Eval(frame)
-	if err != nil {
-		return nil, err
-	}
-
 	left, err = unwrap(left, frame)
 	if err != nil {
 		return nil, err
 	}
-	right, err = unwrap(right, frame)
-	if err != nil {
-		return nil, err
+	for _, op := range multiplication.Ops {
+		right, err := op.Next.Eval(frame)
+		if err != nil {
+			return nil, err
+		}
+		right, err = unwrap(right, frame)
+		if err != nil {
+			return nil, err
+		}
+		left, err = evalMultiplication(frame, multiplication.Unary.Pos.String(), op.Op, left, right)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return left, nil
+}
 
-	err = traceError(frame, multiplication.Unary.Pos.String(),
-		"'*', '/', and '%' can only be used between [string, string], [number, number], not: ["+left.String()+", "+right.String()+"]")
+func evalMultiplication(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	if op == "*" {
+		// Repetition e.g. `[0] * 3` or `3 * "ab"`
+		sequence, count := left, right
+		if _, okNum := left.(NumberValue); okNum {
+			sequence, count = right, left
+		}
+		switch sequence.(type) {
+		case ListValue, StringValue:
+			return repeatValue(frame, position, sequence, count)
+		}
+	}
 
 	leftNum, okLeft := left.(NumberValue)
-	if !okLeft {
-		return nil, err
-	}
 	rightNum, okRight := right.(NumberValue)
-	if !okRight {
-		return nil, err
+	if !okLeft || !okRight {
+		allowed := "[number, number]"
+		if op == "*" {
+			allowed = "[number, number], [list, number], [string, number]"
+		}
+		return nil, traceError(frame, position,
+			"'"+op+"' can only be used between "+allowed+", not: ["+typeName(left)+", "+typeName(right)+"]")
 	}
-	if *multiplication.Op == "*" {
+	if op == "*" {
 		return NumberValue{val: leftNum.val * rightNum.val}, nil
 	}
-	if *multiplication.Op == "/" {
+	if op == "/" {
 		return NumberValue{val: leftNum.val / rightNum.val}, nil
 	}
-	if *multiplication.Op == "%" {
-		return NumberValue{
-			val: float64(int(math.Round(leftNum.val)) % int(math.Round(rightNum.val))),
-		}, nil
+	if op == "~/" {
+		// Like the bitwise operators, only whole numbers can be used
+		if _, okLeft := toInteger(left); !okLeft {
+			return nil, traceError(frame, position,
+				"'~/' can only be used between [integer, integer], not: ["+left.String()+", "+right.String()+"]")
+		}
+		if _, okRight := toInteger(right); !okRight {
+			return nil, traceError(frame, position,
+				"'~/' can only be used between [integer, integer], not: ["+left.String()+", "+right.String()+"]")
+		}
+		if rightNum.val == 0 {
+			return nil, traceError(frame, position, "integer division by zero")
+		}
+		return NumberValue{val: math.Floor(leftNum.val / rightNum.val)}, nil
+	}
+	if op == "%" {
+		divisor := int(math.Round(rightNum.val))
+		if divisor == 0 {
+			return nil, traceError(frame, position, "integer division by zero")
+		}
+		return NumberValue{val: float64(int(math.Round(leftNum.val)) % divisor)}, nil
 	}
 	panic("unreachable")
 }
 
 func (unary Unary) Eval(frame *StackFrame) (Value, error) {
 	if unary.Op == nil {
-		return unary.Primary.Eval(frame)
+		return unary.Power.Eval(frame)
 	}
-	if *unary.Op == "!" {
-		value, err := unary.Unary.Eval(frame)
-		if err != nil {
-			return nil, err
-		}
-		value, err = unwrap(value, frame)
-		if err != nil {
-			return nil, err
-		}
+	value, err := unary.Unary.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	value, err = unwrap(value, frame)
+	if err != nil {
+		return nil, err
+	}
+	return evalUnary(frame, unary.Unary.Pos.String(), *unary.Op, value)
+}
+
+func evalUnary(frame *StackFrame, position string, op string, value Value) (Value, error) {
+	if op == "!" {
 		if boolValue, ok := value.(BoolValue); ok {
 			return BoolValue{val: !boolValue.val}, nil
 		}
-		return nil, traceError(frame, unary.Unary.Pos.String(),
+		return nil, traceError(frame, position,
 			"expected bool after '!', found"+value.String())
 	}
-	if *unary.Op == "-" {
-		value, err := unary.Unary.Eval(frame)
-		if err != nil {
-			return nil, err
-		}
-		value, err = unwrap(value, frame)
-		if err != nil {
-			return nil, err
-		}
+	if op == "-" {
 		if numberValue, ok := value.(NumberValue); ok {
 			return NumberValue{val: -numberValue.val}, nil
 		}
-		return nil, traceError(frame, unary.Unary.Pos.String(),
+		return nil, traceError(frame, position,
 			"expected bool after '-', found"+value.String())
 	}
+	if op == "~" {
+		if intValue, ok := toInteger(value); ok {
+			return NumberValue{val: float64(^intValue)}, nil
+		}
+		return nil, traceError(frame, position,
+			"expected integer after '~', found: "+value.String())
+	}
 	panic("unreachable")
 }
 
+func (power Power) String() string {
+	return "power"
+}
+
+func (power Power) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+func (power Power) Eval(frame *StackFrame) (Value, error) {
+	left, err := power.Primary.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	if power.Op == nil {
+		return left, nil
+	}
+	right, err := power.Next.Eval(frame)
+	if err != nil {
+		return nil, err
+	}
+	left, err = unwrap(left, frame)
+	if err != nil {
+		return nil, err
+	}
+	right, err = unwrap(right, frame)
+	if err != nil {
+		return nil, err
+	}
+	return evalPower(frame, power.Primary.Pos.String(), *power.Op, left, right)
+}
+
+func evalPower(frame *StackFrame, position string, op string, left Value, right Value) (Value, error) {
+	if leftNum, okLeft := left.(NumberValue); okLeft {
+		if rightNum, okRight := right.(NumberValue); okRight {
+			return NumberValue{val: math.Pow(leftNum.val, rightNum.val)}, nil
+		}
+	}
+	return nil, traceError(frame, position,
+		"'**' can only be used between [number, number], not: ["+left.String()+", "+right.String()+"]")
+}
+
 func (primary Primary) String() string {
 	return "primary"
 }
 
 func (primary Primary) Eval(frame *StackFrame) (Value, error) {
+	value, err := primary.evalOperand(frame)
+	if err != nil {
+		return nil, err
+	}
+	if primary.CallChain != nil {
+		return evalCallChain(frame, value, primary.CallChain, nil)
+	}
+	return value, nil
+}
+
+// The call chain that follows a primary, if any
+func (primary Primary) callChain() *CallChain {
+	if primary.Call != nil {
+		return primary.Call.CallChain
+	}
+	if primary.SubExpression != nil {
+		return primary.SubExpression.CallChain
+	}
+	return primary.CallChain
+}
+
+// Evaluate a primary without its trailing call chain
+func (primary Primary) evalOperand(frame *StackFrame) (Value, error) {
+	if primary.value != nil {
+		return primary.value, nil
+	}
 	if primary.FuncLiteral != nil {
 		return primary.FuncLiteral.Eval(frame)
 	}
@@ -950,7 +1922,7 @@ func (primary Primary) Eval(frame *StackFrame) (Value, error) {
 		return primary.SubExpression.Eval(frame)
 	}
 	if primary.Number != nil {
-		return NumberValue{val: *primary.Number}, nil
+		return NumberValue{val: float64(*primary.Number)}, nil
 	}
 	if primary.Str != nil {
 		// TODO: Parse strings without including quote `"` marks
@@ -984,13 +1956,34 @@ func (functionLiteral FuncLiteral) Eval(frame *StackFrame) (Value, error) {
 	closureFrame := frame.GetChild(frame.filename + ":" + functionLiteral.Pos.String() + ": function declared")
 	functionValue := FunctionValue{
 		position:   functionLiteral.Pos.String(),
-		parameters: functionLiteral.Params,
+		parameters: paramNames(functionLiteral.Params),
+		types:      paramTypes(functionLiteral.Params),
 		frame:      closureFrame,
 		statements: functionLiteral.Block,
+		generator:  containsYield(functionLiteral.Block),
 	}
 	return functionValue, nil
 }
 
+// Declare a block's named functions before it runs so they can
+// call each other regardless of order
+func hoistFunctions(frame *StackFrame, statements []*Statement) {
+	for _, statement := range statements {
+		if funcStatement := statement.Func; funcStatement != nil {
+			closureFrame := frame.GetChild(frame.filename + ":" + funcStatement.Pos.String() + ": function declared")
+			frame.declare(funcStatement.Name, FunctionValue{
+				name:       funcStatement.Name,
+				position:   funcStatement.Pos.String(),
+				parameters: paramNames(funcStatement.Params),
+				types:      paramTypes(funcStatement.Params),
+				frame:      closureFrame,
+				statements: funcStatement.Block,
+				generator:  containsYield(funcStatement.Block),
+			})
+		}
+	}
+}
+
 func (listLiteral ListLiteral) String() string {
 	return "list literal"
 }
@@ -1000,15 +1993,52 @@ func (listLiteral ListLiteral) Equals(other Value) (bool, error) {
 }
 
 func (listLiteral ListLiteral) Eval(frame *StackFrame) (Value, error) {
+	if len(listLiteral.Clauses) > 0 {
+		if len(listLiteral.Items) != 1 {
+			return nil, traceError(frame, listLiteral.Pos.String(),
+				"list comprehensions take a single item expression")
+		}
+		comprehensionFrame := frame.GetChild(frame.filename + ":" + listLiteral.Pos.String() + ": list comprehension")
+		listValue := newListValue(0)
+		err := evalComprehension(comprehensionFrame, listLiteral.Pos.String(), listLiteral.Clauses, func() error {
+			value, err := listLiteral.Items[0].Eval(comprehensionFrame)
+			if err != nil {
+				return err
+			}
+			value, err = unwrap(value, comprehensionFrame)
+			if err != nil {
+				return err
+			}
+			if limit := frame.runtime.allocate(listItemSize); limit != nil {
+				return limit.at(comprehensionFrame, listLiteral.Pos.String())
+			}
+			listValue.Append(value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return listValue, nil
+	}
+
 	values := make(map[int]*Value, 0)
 	for i, expr := range listLiteral.Items {
 		value, err := expr.Eval(frame)
 		if err != nil {
 			return nil, err
 		}
+		// Store values rather than identifiers, which would otherwise
+		// be resolved later in whatever scope the item is read from
+		value, err = unwrap(value, frame)
+		if err != nil {
+			return nil, err
+		}
 		values[i] = &value
 	}
-	return ListValue{val: values}, nil
+	if limit := frame.runtime.allocate(len(values) * listItemSize); limit != nil {
+		return nil, limit.at(frame, listLiteral.Pos.String())
+	}
+	return ListValue{val: values, frozen: new(bool)}, nil
 }
 
 func (dictLiteral DictLiteral) String() string {
@@ -1020,39 +2050,122 @@ func (dictLiteral DictLiteral) Equals(other Value) (bool, error) {
 }
 
 func (dictLiteral DictLiteral) Eval(frame *StackFrame) (Value, error) {
-	dictValue := DictValue{val: make(map[string]*Value)}
+	dictValue := newDictValue(0)
+	if len(dictLiteral.Clauses) > 0 {
+		if len(dictLiteral.Items) != 1 {
+			return nil, traceError(frame, dictLiteral.Pos.String(),
+				"dictionary comprehensions take a single key-value expression")
+		}
+		comprehensionFrame := frame.GetChild(frame.filename + ":" + dictLiteral.Pos.String() + ": dictionary comprehension")
+		err := evalComprehension(comprehensionFrame, dictLiteral.Pos.String(), dictLiteral.Clauses, func() error {
+			return evalDictKV(comprehensionFrame, dictLiteral.Pos.String(), dictValue, dictLiteral.Items[0])
+		})
+		if err != nil {
+			return nil, err
+		}
+		return dictValue, nil
+	}
+
 	if dictLiteral.Items != nil {
 		for _, dictKV := range dictLiteral.Items {
-			var key string
-			if dictKV.KeyExpr != nil {
-				value, err := dictKV.KeyExpr.Eval(frame)
-				if err != nil {
-					return nil, err
-				}
-				value, err = unwrap(value, frame)
-				if err != nil {
-					return nil, err
-				}
-				if strValue, okStr := value.(StringValue); okStr {
-					key = string(strValue.val)
-				}
-			} else if dictKV.KeyStr != nil {
-				key = *dictKV.KeyStr
-			}
-
-			value, err := dictKV.ValueExpr.Eval(frame)
+			err := evalDictKV(frame, dictLiteral.Pos.String(), dictValue, dictKV)
 			if err != nil {
 				return nil, err
 			}
-			if key == "" {
-				return nil, traceError(frame, dictLiteral.Pos.String(), "can't set empty string as dictionary key")
-			}
-			dictValue.Set(key, value)
 		}
 	}
 	return dictValue, nil
 }
 
+func evalDictKV(frame *StackFrame, position string, dictValue DictValue, dictKV *DictKV) error {
+	var key Value = UndefinedValue{}
+	if dictKV.KeyExpr != nil {
+		value, err := dictKV.KeyExpr.Eval(frame)
+		if err != nil {
+			return err
+		}
+		key, err = unwrap(value, frame)
+		if err != nil {
+			return err
+		}
+	} else if dictKV.KeyStr != nil {
+		key = StringValue{val: []byte(*dictKV.KeyStr)}
+	}
+
+	value, err := dictKV.ValueExpr.Eval(frame)
+	if err != nil {
+		return err
+	}
+	value, err = unwrap(value, frame)
+	if err != nil {
+		return err
+	}
+	return setDictItem(frame, position, dictValue, key, value)
+}
+
+// Keys that aren't strings are treated as empty
+func setDictItem(frame *StackFrame, position string, dictValue DictValue, key Value, value Value) error {
+	var keyStr string
+	if strValue, okStr := key.(StringValue); okStr {
+		keyStr = string(strValue.val)
+	}
+	if keyStr == "" {
+		return traceError(frame, position, "can't set empty string as dictionary key")
+	}
+	if limit := frame.runtime.allocate(dictEntrySize + len(keyStr)); limit != nil {
+		return limit.at(frame, position)
+	}
+	dictValue.Set(keyStr, value)
+	return nil
+}
+
+// Run `emit` once for every combination of the comprehension's `for` clauses
+// that passes its `if` clauses. Loop variables live in the comprehension's frame
+func evalComprehension(frame *StackFrame, position string, clauses []*ComprehensionClause, emit func() error) error {
+	if clauses[0].For == nil {
+		return traceError(frame, position, "comprehensions should start with a for clause")
+	}
+	return evalComprehensionClauses(frame, clauses, emit)
+}
+
+func evalComprehensionClauses(frame *StackFrame, clauses []*ComprehensionClause, emit func() error) error {
+	if len(clauses) == 0 {
+		return emit()
+	}
+	clause := clauses[0]
+	if clause.Condition != nil {
+		condition, err := clause.Condition.Eval(frame)
+		if err != nil {
+			return err
+		}
+		condition, err = unwrap(condition, frame)
+		if err != nil {
+			return err
+		}
+		ok, err := isTrue(frame, clause.Condition.Pos.String(), condition)
+		if err != nil || !ok {
+			return err
+		}
+		return evalComprehensionClauses(frame, clauses[1:], emit)
+	}
+
+	iterable, err := clause.For.Iterable.Eval(frame)
+	if err != nil {
+		return err
+	}
+	iterable, err = unwrap(iterable, frame)
+	if err != nil {
+		return err
+	}
+	return iterate(frame, clause.For.Iterable.Pos.String(), iterable, func(key Value, value Value) error {
+		if stop := frame.runtime.step(); stop != nil {
+			return stop.at(frame, clause.Pos.String())
+		}
+		bindForIn(frame, clause.For, iterable, key, value)
+		return evalComprehensionClauses(frame, clauses[1:], emit)
+	})
+}
+
 func (call Call) String() string {
 	return "call"
 }
@@ -1066,7 +2179,7 @@ func (call Call) Eval(frame *StackFrame) (Value, error) {
 	if err != nil {
 		return nil, err
 	}
-	return evalCallChain(frame, value, call.CallChain)
+	return evalCallChain(frame, value, call.CallChain, nil)
 }
 
 func (subExpression SubExpression) String() string {
@@ -1083,61 +2196,109 @@ func (subExpression SubExpression) Eval(frame *StackFrame) (Value, error) {
 		return nil, err
 	}
 	if subExpression.CallChain != nil {
-		return evalCallChain(frame, value, subExpression.CallChain)
+		return evalCallChain(frame, value, subExpression.CallChain, nil)
 	}
 	return value, nil
 }
 
-func evalLoop(loopFrame *StackFrame, conditionExpr *Expr, block []*Statement, post *Expr) (Value, error) {
+// Unlabeled breaks and continues always target the innermost loop
+func isLoopTarget(label *string, target string) bool {
+	return target == "" || label != nil && *label == target
+}
+
+func evalLoop(loopFrame *StackFrame, position string, label *string, conditionExpr *Expr, block []*Statement, post *Expr) (Value, error) {
 	var condition Value
 	var err error
 	for {
+		if stop := loopFrame.runtime.step(); stop != nil {
+			return nil, stop.at(loopFrame, position)
+		}
 		// Having no condition is fine, assume truthy
 		if conditionExpr != nil {
 			condition, err = conditionExpr.Eval(loopFrame)
 			if err != nil {
 				return nil, err
 			}
-		} else {
-			condition = BoolValue{val: true}
-		}
-
-		if boolValue, okBool := condition.(BoolValue); okBool {
-			if !boolValue.val {
+			condition, err = unwrap(condition, loopFrame)
+			if err != nil {
+				return nil, err
+			}
+			ok, err := isLoopCondition(loopFrame, conditionExpr.Pos.String(), condition)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
 				return UndefinedValue{}, nil
 			}
-			for _, statement := range block {
-				_, err = statement.Eval(loopFrame)
-				if err != nil {
-					if _, okCont := err.(ContinueError); okCont {
-						break
-					}
-					if _, okCont := err.(BreakError); okCont {
-						return UndefinedValue{}, nil
-					}
-					return nil, err
+		}
+
+		hoistFunctions(loopFrame, block)
+		for _, statement := range block {
+			_, err = statement.Eval(loopFrame)
+			if err != nil {
+				if contErr, okCont := err.(ContinueError); okCont && isLoopTarget(label, contErr.label) {
+					break
 				}
-			}
-			if post != nil {
-				_, err = post.Eval(loopFrame)
-				if err != nil {
-					return nil, err
+				if breakErr, okBreak := err.(BreakError); okBreak && isLoopTarget(label, breakErr.label) {
+					return UndefinedValue{}, nil
 				}
+				return nil, err
 			}
-		} else {
-			valueType, err := doType(loopFrame, conditionExpr.Pos.String(), []Value{condition})
+		}
+		if post != nil {
+			_, err = post.Eval(loopFrame)
 			if err != nil {
 				return nil, err
 			}
-			return nil, traceError(loopFrame, conditionExpr.Pos.String(),
-				"loop condition expression should evaluate to a boolean, found: "+valueType.String())
 		}
 	}
 }
 
-func evalCallChain(frame *StackFrame, value Value, callChain *CallChain) (Value, error) {
+func isLoopCondition(loopFrame *StackFrame, position string, condition Value) (bool, error) {
+	if boolValue, okBool := condition.(BoolValue); okBool {
+		return boolValue.val, nil
+	}
+	valueType, err := doType(loopFrame, position, []Value{condition})
+	if err != nil {
+		return false, err
+	}
+	return false, traceError(loopFrame, position,
+		"loop condition expression should evaluate to a boolean, found: "+valueType.String())
+}
+
+// Optional links (`?.`) short-circuit the rest of the chain on undefined
+func (callChain CallChain) isOptional() bool {
+	if callChain.Index != nil {
+		return callChain.Index.Optional != nil
+	}
+	if callChain.Property != nil {
+		return callChain.Property.Optional != nil
+	}
+	if callChain.Args != nil {
+		return callChain.Args.Optional != nil
+	}
+	return false
+}
+
+func (callChain CallChain) endsWithCall() bool {
+	for callChain.Next != nil {
+		callChain = *callChain.Next
+	}
+	return callChain.Args != nil
+}
+
+// `piped` is prepended to the arguments of the chain's final call when not nil
+func evalCallChain(frame *StackFrame, value Value, callChain *CallChain, piped Value) (Value, error) {
 	for {
-		value = unref(value)
+		var err error
+		value, err = unwrap(value, frame)
+		if err != nil {
+			return nil, traceError(frame, callChain.Pos.String(), err.Error())
+		}
+		optional := callChain.isOptional()
+		if _, okUndefined := value.(UndefinedValue); okUndefined && optional {
+			return UndefinedValue{}, nil
+		}
 		if callChain.Index != nil {
 			index, err := callChain.Index.Expr.Eval(frame)
 			if err != nil {
@@ -1147,125 +2308,27 @@ func evalCallChain(frame *StackFrame, value Value, callChain *CallChain) (Value,
 			if err != nil {
 				return nil, err
 			}
-			if dictValue, okDict := value.(DictValue); okDict {
-				// When indexing a dict by number, we stringify it
-				if numberValue, okNumber := index.(NumberValue); okNumber {
-					index = StringValue{val: []byte(nvToS(numberValue))}
-				}
-				if stringValue, okString := index.(StringValue); okString {
-					reference, err := dictValue.Get(string(stringValue.val))
-					if err != nil {
-						value = ReferenceValue{val: dictValue.Set(string(stringValue.val), UndefinedValue{})}
-					} else {
-						value = ReferenceValue{val: reference}
-					}
-				} else {
-					valueType, err := doType(frame, callChain.Index.Expr.Pos.String(), []Value{index})
-					if err != nil {
-						return nil, err
-					}
-					return nil, traceError(frame, callChain.Pos.String(),
-						fmt.Sprintf("dictionaries can only be accessed by string: got '%v' of type %v", index, valueType))
-				}
-			}
-			if listValue, okList := value.(ListValue); okList {
-				if numberValue, okNumber := index.(NumberValue); okNumber {
-					// Note that floats are floored here
-					value, err = listValue.Get(int(numberValue.val))
-					if err != nil {
-						return nil, traceError(frame, callChain.Index.Expr.Pos.String(), err.Error())
-					}
-				} else {
-					valueType, err := doType(frame, callChain.Index.Expr.Pos.String(), []Value{index})
-					if err != nil {
-						return nil, err
-					}
-					return nil, traceError(frame, callChain.Pos.String(),
-						fmt.Sprintf("lists can only be accessed by number: got '%v' of type %v", index, valueType))
-				}
-			}
-			if strValue, okStr := value.(StringValue); okStr {
-				if numberValue, okNumber := index.(NumberValue); okNumber {
-					// Note that floats are floored here
-					value, err = strValue.Get(int(numberValue.val))
-					if err != nil {
-						return nil, traceError(frame, callChain.Index.Expr.Pos.String(), err.Error())
-					}
-				} else {
-					valueType, err := doType(frame, callChain.Index.Expr.Pos.String(), []Value{index})
-					if err != nil {
-						return nil, err
-					}
-					return nil, traceError(frame, callChain.Pos.String(),
-						fmt.Sprintf("strings can only be accessed by number: got '%v' of type %v", index, valueType))
-				}
+			value, err = indexValue(frame, callChain.Pos.String(), callChain.Index.Expr.Pos.String(), value, index, optional)
+			if err != nil {
+				return nil, err
 			}
 		} else if callChain.Property != nil {
-			if dictValue, okDict := value.(DictValue); okDict {
-				reference, err := dictValue.Get(*callChain.Property.Ident)
-				if err != nil {
-					value = ReferenceValue{val: dictValue.Set(*callChain.Property.Ident, UndefinedValue{})}
-				} else {
-					value = ReferenceValue{val: reference}
-				}
-			}
-			if listValue, okList := value.(ListValue); okList {
-				// Check that the function will be called
-				if callChain.Next != nil && callChain.Next.Args != nil {
-					// Evaluate the arguments into values
-					args, err := evalExprs(frame, callChain.Next.Args.Exprs)
-					if err != nil {
-						return nil, err
-					}
-					// Prepend the list value to the args
-					// Note: args might be empty
-					args = append([]Value{listValue}, args...)
-
-					// Check for list functions
-					if *callChain.Property.Ident == "append" {
-						value, err = doAppend(frame, callChain.Pos.String(), args)
-					} else if *callChain.Property.Ident == "pop" {
-						value, err = doPop(frame, callChain.Pos.String(), args)
-					} else if *callChain.Property.Ident == "prepend" {
-						value, err = doPrepend(frame, callChain.Pos.String(), args)
-					} else if *callChain.Property.Ident == "prepop" {
-						value, err = doPrepop(frame, callChain.Pos.String(), args)
-					} else if *callChain.Property.Ident == "popat" {
-						value, err = doPopat(frame, callChain.Pos.String(), args)
-					} else {
-						return nil, traceError(frame, callChain.Next.Pos.String(),
-							"unknown list function: "+*callChain.Property.Ident)
-					}
-
-					if err != nil {
-						return nil, err
-					}
-					// Fast forward the callChain as we just handled the next step
-					callChain = callChain.Next
-				} else {
-					// TODO: Are there any list properties we want to implement?
-					return nil, traceError(frame, callChain.Pos.String(),
-						"unknown list property: "+*callChain.Property.Ident)
-				}
+			called := callChain.Next != nil && callChain.Next.Args != nil
+			value, err = propertyValue(frame, callChain.Pos.String(), value, *callChain.Property.Ident, called, optional)
+			if err != nil {
+				return nil, err
 			}
 		} else if callChain.Args != nil {
 			args, err := evalExprs(frame, callChain.Args.Exprs)
 			if err != nil {
 				return nil, err
 			}
-			if function, okFunction := value.(FunctionValue); okFunction {
-				value, err = function.Exec(callChain.Pos.String(), args)
-				if err != nil {
-					return nil, err
-				}
-			} else if nativeFunction, okNativeFunction := value.(NativeFunctionValue); okNativeFunction {
-				nativeFunction.frame = frame
-				value, err = nativeFunction.Exec(frame, callChain.Pos.String(), args)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				return nil, traceError(frame, callChain.Pos.String(), "only functions can be called")
+			if piped != nil && callChain.Next == nil {
+				args = append([]Value{piped}, args...)
+			}
+			value, err = callFunction(frame, callChain.Pos.String(), value, args)
+			if err != nil {
+				return nil, err
 			}
 		}
 		if callChain.Next == nil {
@@ -1277,6 +2340,105 @@ func evalCallChain(frame *StackFrame, value Value, callChain *CallChain) (Value,
 	return value, nil
 }
 
+// A reference to an item of a list, dict, or string
+func indexValue(frame *StackFrame, position string, indexPosition string, value Value, index Value, optional bool) (Value, error) {
+	if dictValue, okDict := value.(DictValue); okDict {
+		// When indexing a dict by number, we stringify it
+		if numberValue, okNumber := index.(NumberValue); okNumber {
+			index = StringValue{val: []byte(nvToS(numberValue))}
+		}
+		if stringValue, okString := index.(StringValue); okString {
+			reference, err := dictValue.Get(string(stringValue.val))
+			if err != nil && optional {
+				// Optional reads don't insert missing keys
+				return UndefinedValue{}, nil
+			} else if err != nil {
+				if limit := frame.runtime.allocate(dictEntrySize + len(stringValue.val)); limit != nil {
+					return nil, limit.at(frame, position)
+				}
+				return dictValue.missing(string(stringValue.val)), nil
+			}
+			return ReferenceValue{val: reference, frozen: dictValue.isFrozen()}, nil
+		}
+		valueType, err := doType(frame, indexPosition, []Value{index})
+		if err != nil {
+			return nil, err
+		}
+		return nil, traceError(frame, position,
+			fmt.Sprintf("dictionaries can only be accessed by string: got '%v' of type %v", index, valueType))
+	}
+	if listValue, okList := value.(ListValue); okList {
+		if numberValue, okNumber := index.(NumberValue); okNumber {
+			// Note that floats are floored here
+			value, err := listValue.Get(int(numberValue.val))
+			if err != nil {
+				return nil, traceError(frame, indexPosition, err.Error())
+			}
+			return value, nil
+		}
+		valueType, err := doType(frame, indexPosition, []Value{index})
+		if err != nil {
+			return nil, err
+		}
+		return nil, traceError(frame, position,
+			fmt.Sprintf("lists can only be accessed by number: got '%v' of type %v", index, valueType))
+	}
+	if strValue, okStr := value.(StringValue); okStr {
+		if numberValue, okNumber := index.(NumberValue); okNumber {
+			// Note that floats are floored here
+			value, err := strValue.Get(int(numberValue.val))
+			if err != nil {
+				return nil, traceError(frame, indexPosition, err.Error())
+			}
+			return value, nil
+		}
+		valueType, err := doType(frame, indexPosition, []Value{index})
+		if err != nil {
+			return nil, err
+		}
+		return nil, traceError(frame, position,
+			fmt.Sprintf("strings can only be accessed by number: got '%v' of type %v", index, valueType))
+	}
+	return value, nil
+}
+
+// A reference to a dict's key, or a method bound to the value
+func propertyValue(frame *StackFrame, position string, value Value, name string, called bool, optional bool) (Value, error) {
+	if dictValue, okDict := value.(DictValue); okDict {
+		reference, err := dictValue.Get(name)
+		if err == nil {
+			return ReferenceValue{val: reference, frozen: dictValue.isFrozen()}, nil
+		} else if method, okMethod := frame.runtime.lookupMethod(value, name); okMethod && called {
+			// A dict's own keys shadow its methods
+			return bindMethod(value, name, method), nil
+		} else if optional {
+			// Optional reads don't insert missing keys
+			return UndefinedValue{}, nil
+		}
+		return dictValue.missing(name), nil
+	}
+	if method, okMethod := frame.runtime.lookupMethod(value, name); okMethod {
+		return bindMethod(value, name, method), nil
+	}
+	return nil, traceError(frame, position,
+		fmt.Sprintf("unknown %v property: %v", typeName(value), name))
+}
+
+// Call a user or native function with already evaluated arguments
+func callFunction(frame *StackFrame, position string, value Value, args []Value) (Value, error) {
+	if function, okFunction := value.(FunctionValue); okFunction {
+		return function.Exec(position, args)
+	}
+	if nativeFunction, okNativeFunction := value.(NativeFunctionValue); okNativeFunction {
+		nativeFunction.frame = frame
+		return nativeFunction.Exec(frame, position, args)
+	}
+	if class, okClass := value.(ClassValue); okClass {
+		return class.instantiate(frame, position, args)
+	}
+	return nil, traceError(frame, position, "only functions can be called")
+}
+
 func evalExprs(frame *StackFrame, exprs []*Expr) ([]Value, error) {
 	ret := make([]Value, 0)
 	for _, expr := range exprs {
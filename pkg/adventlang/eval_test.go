@@ -0,0 +1,62 @@
+package adventlang
+
+import (
+	"strings"
+	"testing"
+)
+
+// Run a program on both engines and check that it fails with a message
+func expectError(t *testing.T, source string, message string) {
+	t.Helper()
+	for _, treeWalker := range []bool{false, true} {
+		_, _, err := RunProgramWithOptions("test.adv", source, Options{TreeWalker: treeWalker})
+		if err == nil {
+			t.Fatalf("%q (tree-walker: %v) succeeded, wanted an error containing %q", source, treeWalker, message)
+		}
+		if !strings.Contains(err.Error(), message) {
+			t.Fatalf("%q (tree-walker: %v) failed with %q, wanted %q", source, treeWalker, err.Error(), message)
+		}
+	}
+}
+
+func TestRepeatTooLong(t *testing.T) {
+	expectError(t, `"ab" * 9000000000000000000;`, "test.adv:1:1: '*' would make a string that's too long")
+	expectError(t, `[1, 2] * 4611686018427387904;`, "'*' would make a list that's too long")
+	expectError(t, `let n = 1 << 40; "a" * n;`, "'*' would make a string that's too long")
+}
+
+func TestRepeatEmpty(t *testing.T) {
+	result, _, err := RunProgram("test.adv", `len([] * 9000000000000000000) + len("" * 9000000000000000000);`)
+	if err != nil || result != "0" {
+		t.Fatalf("got %q, %v, wanted 0", result, err)
+	}
+}
+
+func TestRepeatMemoryLimit(t *testing.T) {
+	for _, source := range []string{`"ab" * 9000000000000000000;`, `[1, 2] * 4611686018427387904;`} {
+		_, _, err := RunProgramWithOptions("test.adv", source, Options{MaxMemory: 1000000})
+		if limitError, okLimit := err.(LimitError); !okLimit || limitError.Limit != "memory" {
+			t.Fatalf("%q failed with %v, wanted a memory LimitError", source, err)
+		}
+	}
+}
+
+func TestIntegerDivisionByZero(t *testing.T) {
+	expectError(t, `log(5 % 0);`, "test.adv:1:5: integer division by zero")
+	expectError(t, `let z = 0.2; 5 % z;`, "test.adv:1:14: integer division by zero")
+	expectError(t, `5 ~/ 0;`, "test.adv:1:1: integer division by zero")
+	expectError(t, `let n = 10; n - 1 ~/ 0;`, "test.adv:1:17: integer division by zero")
+}
+
+func TestIntegerBounds(t *testing.T) {
+	expectError(t, `9223372036854775808 | 0;`, "'|' can only be used between [integer, integer]")
+	expectError(t, `2 ** 63 ~/ 1;`, "'~/' can only be used between [integer, integer]")
+	expectError(t, `-(2 ** 63) - 2048 & 1;`, "'&' can only be used between [integer, integer]")
+	// The largest integers on either side fit
+	for _, source := range []string{`(-(2 ** 63) | 0) == -(2 ** 63);`, `((2 ** 63 - 1024) ^ 0) == 2 ** 63 - 1024;`} {
+		result, _, err := RunProgram("test.adv", source)
+		if err != nil || result != "true" {
+			t.Fatalf("%q is %q, %v, wanted true", source, result, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package adventlang
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Programs open files through an fs.FS, see Options. An embed.FS can be
+// used as one too, e.g. to bundle a program with its inputs
+
+// The host's filesystem, without fs.FS's restrictions on paths so that
+// programs can open files by absolute or parent paths
+type OSFS struct{}
+
+func (OSFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// Files held in memory, by their slash-separated paths e.g. "lib/utils.adv".
+// Paths are cleaned before they're looked up, so "./input.txt" opens
+// "input.txt". There are no directories, only the files themselves
+type MemoryFS map[string]string
+
+func (memoryFS MemoryFS) Open(name string) (fs.File, error) {
+	content, ok := memoryFS[path.Clean(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memoryFile{Reader: strings.NewReader(content),
+		info: memoryFileInfo{name: path.Base(name), size: int64(len(content))}}, nil
+}
+
+type memoryFile struct {
+	*strings.Reader
+	info memoryFileInfo
+}
+
+func (file *memoryFile) Stat() (fs.FileInfo, error) {
+	return file.info, nil
+}
+
+func (file *memoryFile) Close() error {
+	return nil
+}
+
+type memoryFileInfo struct {
+	name string
+	size int64
+}
+
+func (info memoryFileInfo) Name() string       { return info.name }
+func (info memoryFileInfo) Size() int64        { return info.size }
+func (info memoryFileInfo) Mode() fs.FileMode  { return 0444 }
+func (info memoryFileInfo) ModTime() time.Time { return time.Time{} }
+func (info memoryFileInfo) IsDir() bool        { return false }
+func (info memoryFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,52 @@
+package adventlang
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestMemoryFS(t *testing.T) {
+	files := MemoryFS{"dir/input.txt": "a\nb"}
+	content, err := fs.ReadFile(files, "./dir/../dir/input.txt")
+	if err != nil || string(content) != "a\nb" {
+		t.Fatalf("got %q, %v", content, err)
+	}
+	info, err := fs.Stat(files, "dir/input.txt")
+	if err != nil || info.Name() != "input.txt" || info.Size() != 3 || info.IsDir() {
+		t.Fatalf("got %v, %v", info, err)
+	}
+	if _, err := files.Open("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, wanted fs.ErrNotExist", err)
+	}
+}
+
+func TestMemoryFSImports(t *testing.T) {
+	files := MemoryFS{
+		"main.adv":          `let lib = import("./lib/lib.adv"); let shared = import("shared.adv"); lib.value + shared.value;`,
+		"lib/lib.adv":       `let value = import("./helper.adv").value + len(list(read_lines("./data.txt")));`,
+		"lib/helper.adv":    `let value = 1;`,
+		"lib/data.txt":      "a\nb",
+		"vendor/shared.adv": `let value = 10;`,
+	}
+	for _, treeWalker := range []bool{false, true} {
+		options := Options{FS: files, ModulePath: []string{"vendor"}, TreeWalker: treeWalker}
+		result, _, err := RunProgramWithOptions("main.adv", files["main.adv"], options)
+		if err != nil || result != "13" {
+			t.Fatalf("(tree-walker: %v) got %q, %v, wanted 13", treeWalker, result, err)
+		}
+	}
+}
+
+func TestMemoryFSMissingImport(t *testing.T) {
+	_, _, err := RunProgramWithOptions("main.adv", `import("./missing.adv");`, Options{FS: MemoryFS{}})
+	if err == nil || !strings.Contains(err.Error(), "import: while reading missing.adv") {
+		t.Fatalf("got %v, wanted a missing file error", err)
+	}
+	// The standard library doesn't need the filesystem
+	result, _, err := RunProgramWithOptions("main.adv", `import("std/math").max(1, 2);`, Options{FS: MemoryFS{}})
+	if err != nil || result != "2" {
+		t.Fatalf("got %q, %v, wanted 2", result, err)
+	}
+}
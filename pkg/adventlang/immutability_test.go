@@ -0,0 +1,60 @@
+package adventlang
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFreezeInPlace(t *testing.T) {
+	expectError(t, `let l = [1]; freeze(l); append(l, 2);`, "append: can't change a frozen list")
+	expectError(t, `let l = [1]; freeze(l); l[0] = 2;`, "can't assign to an item of a frozen value")
+	expectError(t, `let d = {"a": 1}; freeze(d); delete(d, "a");`, "delete: can't change a frozen dict")
+	expectError(t, `let d = {"a": 1}; freeze(d); d.b = 2;`, "can't assign to an item of a frozen value")
+}
+
+func TestFreezeDeep(t *testing.T) {
+	expectError(t, `let l = [[1]]; let inner = l[0]; freeze(l); append(inner, 2);`, "append: can't change a frozen list")
+	expectError(t, `let d = {"a": {"b": 1}}; let inner = d.a; freeze(d); inner.b = 2;`, "can't assign to an item of a frozen value")
+	expectError(t, `let l = [{"a": 1}]; freeze(l); delete(l[0], "a");`, "delete: can't change a frozen dict")
+}
+
+func TestFreezeCycle(t *testing.T) {
+	result, _, err := RunProgram("test.adv", `let l = []; append(l, l); freeze(l); len(l);`)
+	if err != nil || result != "1" {
+		t.Fatalf("got %q, %v, wanted 1", result, err)
+	}
+}
+
+func TestModuleExportsFrozen(t *testing.T) {
+	files := MemoryFS{"lib.adv": `
+let list = [[1]];
+let nested = {"items": [1]};
+let add = func(x) { append(list, [x]); nested.items[0] = x; return len(list); };`}
+	for _, test := range []struct{ source, message string }{
+		{`append(lib.list, 2);`, "append: can't change a frozen list"},
+		{`append(lib.list[0], 2);`, "append: can't change a frozen list"},
+		{`lib.list[0] = 2;`, "can't assign to an item of a frozen value"},
+		{`lib.nested.items[0] = 2;`, "can't assign to an item of a frozen value"},
+		{`delete(lib.nested, "items");`, "delete: can't change a frozen dict"},
+		{`for (item in lib.list) { append(item, 2); }`, "append: can't change a frozen list"},
+		{`append(values(lib.nested)[0], 2);`, "append: can't change a frozen list"},
+		{`append(lib.nested.get("items"), 2);`, "append: can't change a frozen list"},
+		{`append((lib.list + [])[0], 2);`, "append: can't change a frozen list"},
+		{`append((lib.nested | {}).items, 2);`, "append: can't change a frozen list"},
+	} {
+		for _, treeWalker := range []bool{false, true} {
+			source := `let lib = import("./lib.adv"); ` + test.source
+			_, _, err := RunProgramWithOptions("main.adv", source, Options{FS: files, TreeWalker: treeWalker})
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("%q (tree-walker: %v) failed with %v, wanted %q", source, treeWalker, err, test.message)
+			}
+		}
+	}
+
+	// The module can still change them, and importers see the change
+	source := `let lib = import("./lib.adv"); lib.add(5); [len(lib.list), lib.list[1][0], lib.nested.items[0]];`
+	result, _, err := RunProgramWithOptions("main.adv", source, Options{FS: files})
+	if err != nil || result != "[2, 5, 5]" {
+		t.Fatalf("got %q, %v, wanted [2, 5, 5]", result, err)
+	}
+}
@@ -0,0 +1,113 @@
+package adventlang
+
+import (
+	"context"
+)
+
+// An Interpreter evaluates code against global variables that are kept
+// between calls, and that can be defined from Go. Go can call the functions
+// that programs define. An Interpreter runs one thing at a time, but separate
+// Interpreters can run in parallel
+type Interpreter struct {
+	context  Context
+	filename string
+	// Whether a program or function is running, calls from native
+	// functions count against its limits rather than starting afresh
+	running bool
+}
+
+type InterpreterOptions struct {
+	Options
+	// The name of evaluated code in errors, "main" if empty
+	Filename string
+}
+
+func NewInterpreter(options InterpreterOptions) *Interpreter {
+	filename := options.Filename
+	if filename == "" {
+		filename = "main"
+	}
+	interpreter := &Interpreter{filename: filename}
+	interpreter.context.Init(filename)
+	interpreter.context.stackFrame.runtime = newRuntimeState(options.Options)
+	InjectRuntime(&interpreter.context)
+	return interpreter
+}
+
+// Declare a global variable, replacing any builtin with the same name
+func (interpreter *Interpreter) Define(name string, value Value) {
+	interpreter.context.stackFrame.declare(name, value)
+}
+
+func (interpreter *Interpreter) RegisterNative(name string, fn NativeFunc) {
+	interpreter.Define(name, NewNativeFunction(name, fn))
+}
+
+// Look up a global variable, e.g. one that evaluated code declared
+func (interpreter *Interpreter) Get(name string) (Value, bool) {
+	variable := interpreter.context.stackFrame.local(name)
+	if variable == nil {
+		return nil, false
+	}
+	return *variable, true
+}
+
+// Evaluate code and return the value of its last statement. Variables that
+// it declares at the top level are globals for the code evaluated after it
+func (interpreter *Interpreter) Eval(source string) (Value, error) {
+	return interpreter.EvalContext(context.Background(), source)
+}
+
+// Like Eval, but stops with a CancelledError once ctx is done
+func (interpreter *Interpreter) EvalContext(ctx context.Context, source string) (Value, error) {
+	return interpreter.run(ctx, interpreter.filename, source)
+}
+
+// Evaluate a file's source like Eval, with its filename in errors
+func (interpreter *Interpreter) Run(filename string, source string) (Value, error) {
+	return interpreter.run(context.Background(), filename, source)
+}
+
+func (interpreter *Interpreter) run(ctx context.Context, filename string, source string) (Value, error) {
+	frame := &interpreter.context.stackFrame
+	frame.filename = filename
+	defer interpreter.enter(ctx)()
+	value, err := execSource(frame, filename, source)
+	if err != nil {
+		return nil, err
+	}
+	return unref(value), nil
+}
+
+// Call a function, native function, or class with arguments. Errors are
+// reported at the position where the function was defined
+func (interpreter *Interpreter) CallFunction(fn Value, args ...Value) (Value, error) {
+	position := "0:0"
+	if functionValue, okFunction := fn.(FunctionValue); okFunction {
+		position = functionValue.position
+	}
+	defer interpreter.enter(context.Background())()
+	value, err := callFunction(&interpreter.context.stackFrame, position, fn, args)
+	if err != nil {
+		return nil, err
+	}
+	return unref(value), nil
+}
+
+// Close the files and generators that programs left open, e.g. an iterator
+// from `read_lines` that's kept in a global. They're done if they're used
+// again, the Interpreter itself can still be used
+func (interpreter *Interpreter) Close() {
+	interpreter.context.stackFrame.runtime.closeResources()
+}
+
+// Reset the limits unless this is a call from a running program, and
+// return a function that marks the end of the run
+func (interpreter *Interpreter) enter(ctx context.Context) func() {
+	if interpreter.running {
+		return func() {}
+	}
+	interpreter.running = true
+	interpreter.context.stackFrame.runtime.start(ctx)
+	return func() { interpreter.running = false }
+}
@@ -0,0 +1,171 @@
+package adventlang
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNativeFunctions(t *testing.T) {
+	interpreter := NewInterpreter(InterpreterOptions{Filename: "test.adv"})
+	interpreter.RegisterNative("double", func(args []Value) (Value, error) {
+		return NewNumber(args[0].(NumberValue).Float64() * 2), nil
+	})
+	interpreter.RegisterNative("nothing", func(args []Value) (Value, error) {
+		return nil, nil
+	})
+	interpreter.RegisterNative("fail", func(args []Value) (Value, error) {
+		return nil, errors.New("bad input")
+	})
+	interpreter.Define("limit", NewNumber(10))
+
+	value, err := interpreter.Eval(`double(limit) + 1;`)
+	if err != nil || value.(NumberValue).Float64() != 21 {
+		t.Fatalf("got %v, %v, wanted 21", value, err)
+	}
+	value, err = interpreter.Eval(`nothing();`)
+	if _, okUndefined := value.(UndefinedValue); err != nil || !okUndefined {
+		t.Fatalf("got %v, %v, wanted undefined", value, err)
+	}
+	_, err = interpreter.Eval(`fail();`)
+	if err == nil || !strings.Contains(err.Error(), "test.adv:1:5: fail: bad input") {
+		t.Fatalf("got %v, wanted the native function's error at the call", err)
+	}
+}
+
+func TestCallFunction(t *testing.T) {
+	interpreter := NewInterpreter(InterpreterOptions{})
+	add, err := interpreter.Eval(`let base = 100; func add(a, b) { return base + a + b; } add;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := interpreter.CallFunction(add, NewNumber(1), NewNumber(2))
+	if err != nil || value.(NumberValue).Float64() != 103 {
+		t.Fatalf("got %v, %v, wanted 103", value, err)
+	}
+
+	// Natives and classes can be called too
+	length, _ := interpreter.Get("len")
+	value, err = interpreter.CallFunction(length, NewString("abc"))
+	if err != nil || value.(NumberValue).Float64() != 3 {
+		t.Fatalf("got %v, %v, wanted 3", value, err)
+	}
+	class, err := interpreter.Eval(`class Point { x = 1; } Point;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = interpreter.CallFunction(class)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point, err := FromValue(value); err != nil || point.(map[string]interface{})["x"] != 1.0 {
+		t.Fatalf("got %v, %v, wanted a Point", point, err)
+	}
+
+	// Errors come from where the function was defined
+	fail, err := interpreter.Eval("let fail = func() {\n  return 1 + \"a\";\n};\nfail;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := interpreter.CallFunction(fail); err == nil || !strings.Contains(err.Error(), "main:2:") {
+		t.Fatalf("got %v, wanted an error in main", err)
+	}
+}
+
+func TestEvalKeepsGlobals(t *testing.T) {
+	for _, treeWalker := range []bool{false, true} {
+		interpreter := NewInterpreter(InterpreterOptions{Options: Options{TreeWalker: treeWalker}})
+		// Declarations are checked by the expressions after them
+		steps := []struct{ source, want string }{
+			{`let total = 1;`, ""},
+			{`func add(n) { total = total + n; return total; }`, ""},
+			{`add(2);`, "3"},
+			{`add(total);`, "6"},
+			{`const items = [total];`, ""},
+			{`items[0] + total;`, "12"},
+		}
+		for _, step := range steps {
+			value, err := interpreter.Eval(step.source)
+			if err != nil {
+				t.Fatalf("(tree-walker: %v) %q failed: %v", treeWalker, step.source, err)
+			}
+			if step.want != "" && value.String() != step.want {
+				t.Fatalf("(tree-walker: %v) %q is %v, wanted %v", treeWalker, step.source, value, step.want)
+			}
+		}
+		if total, ok := interpreter.Get("total"); !ok || total.String() != "6" {
+			t.Fatalf("(tree-walker: %v) total is %v", treeWalker, total)
+		}
+	}
+}
+
+func TestEvalAfterError(t *testing.T) {
+	interpreter := NewInterpreter(InterpreterOptions{})
+	if _, err := interpreter.Eval(`let x = 1; undefined_function();`); err == nil {
+		t.Fatal("calling an undefined function succeeded")
+	}
+	// Constants stay constant
+	if _, err := interpreter.Eval(`const y = 1;`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := interpreter.Eval(`y = 2;`); err == nil {
+		t.Fatal("reassigned a constant from an earlier Eval")
+	}
+	value, err := interpreter.Eval(`x + y;`)
+	if err != nil || value.String() != "2" {
+		t.Fatalf("got %v, %v, wanted 2", value, err)
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	// Each call gets the whole budget
+	interpreter := NewInterpreter(InterpreterOptions{Options: Options{MaxSteps: 1000}})
+	for i := 0; i < 3; i++ {
+		if _, err := interpreter.Eval(`for (let i = 0; i < 500; i = i + 1) {}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := interpreter.Eval(`while (true) {}`)
+	if limitError, okLimit := err.(LimitError); !okLimit || limitError.Limit != "steps" {
+		t.Fatalf("got %v, wanted a steps LimitError", err)
+	}
+
+	// The globals can still be used after a program is stopped
+	interpreter = NewInterpreter(InterpreterOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = interpreter.EvalContext(ctx, `let f = func() { while (true) {} }; f();`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, wanted context.DeadlineExceeded", err)
+	}
+	if value, err := interpreter.Eval(`type(f);`); err != nil || value.String() != "function" {
+		t.Fatalf("got %v, %v, wanted f to be defined", value, err)
+	}
+}
+
+func TestInterpretersInParallel(t *testing.T) {
+	var wait sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			interpreter := NewInterpreter(InterpreterOptions{})
+			interpreter.Define("n", NewNumber(float64(i)))
+			value, err := interpreter.Eval(`let sum = 0; for (let j = 0; j < 1000; j = j + 1) { sum = sum + n; } sum;`)
+			if err == nil && value.(NumberValue).Float64() != float64(i*1000) {
+				err = errors.New("wrong sum: " + value.String())
+			}
+			errs[i] = err
+		}(i)
+	}
+	wait.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
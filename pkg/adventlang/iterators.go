@@ -0,0 +1,395 @@
+package adventlang
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// Lists, strings, and dicts can be iterated over. So can any dict with a
+// `next` function (an iterator) which returns `{"value": v, "done": bool}`
+// on each call. If it also has a `close` function, that's called when a loop
+// stops before the iterator is done, e.g. after a `break`. Generators are
+// iterators whose `next` runs the function until its next `yield`
+
+// Returns the next key (an index or dict key) and value until done
+type iterator func() (key Value, value Value, done bool, err error)
+
+func getIterator(frame *StackFrame, position string, iterable Value) (iterator, error) {
+	switch iterableValue := iterable.(type) {
+	case ListValue:
+		i := 0
+		return func() (Value, Value, bool, error) {
+			// The list may shrink while iterating
+			if i >= len(iterableValue.val) {
+				return nil, nil, true, nil
+			}
+			i++
+			return NumberValue{val: float64(i - 1)}, itemOf(iterableValue.isFrozen(), *iterableValue.val[i-1]), false, nil
+		}, nil
+	case StringValue:
+		i := 0
+		return func() (Value, Value, bool, error) {
+			if i >= len(iterableValue.val) {
+				return nil, nil, true, nil
+			}
+			i++
+			return NumberValue{val: float64(i - 1)}, StringValue{val: []byte{iterableValue.val[i-1]}}, false, nil
+		}, nil
+	case DictValue:
+		if next, okNext := iterableValue.val["next"]; okNext && isFunction(*next) {
+			return getProtocolIterator(frame, position, *next), nil
+		}
+		keys := make([]string, 0, len(iterableValue.val))
+		for key := range iterableValue.val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		i := 0
+		return func() (Value, Value, bool, error) {
+			for i < len(keys) {
+				key := keys[i]
+				i++
+				// Skip keys deleted while iterating
+				if value, okValue := iterableValue.val[key]; okValue {
+					return StringValue{val: []byte(key)}, itemOf(iterableValue.isFrozen(), *value), false, nil
+				}
+			}
+			return nil, nil, true, nil
+		}, nil
+	}
+	return nil, traceError(frame, position,
+		"only lists, strings, dictionaries, and iterators can be iterated over, got: "+typeName(iterable))
+}
+
+func getProtocolIterator(frame *StackFrame, position string, next Value) iterator {
+	i := 0
+	return func() (Value, Value, bool, error) {
+		result, err := callFunction(frame, position, next, []Value{})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if resultDict, okDict := unref(result).(DictValue); okDict {
+			done, okDone := resultDict.val["done"]
+			if okDone {
+				if doneValue, okBool := unref(*done).(BoolValue); okBool {
+					if doneValue.val {
+						return nil, nil, true, nil
+					}
+					var value Value = UndefinedValue{}
+					if item, okItem := resultDict.val["value"]; okItem {
+						value = unref(*item)
+					}
+					i++
+					return NumberValue{val: float64(i - 1)}, value, false, nil
+				}
+			}
+		}
+		return nil, nil, false, traceError(frame, position,
+			"an iterator's next function should return {\"value\": value, \"done\": bool}, got: "+result.String())
+	}
+}
+
+func isFunction(value Value) bool {
+	switch value.(type) {
+	case FunctionValue, NativeFunctionValue:
+		return true
+	}
+	return false
+}
+
+// The item of an iteration when only one loop variable is bound:
+// a dict's key, otherwise the value
+func iterationItem(iterable Value, key Value, value Value) Value {
+	if dictValue, okDict := iterable.(DictValue); okDict {
+		if _, okNext := dictValue.val["next"]; !okNext {
+			return key
+		}
+	}
+	return value
+}
+
+// Call an iterator's `close` function if it has one
+func closeIterator(frame *StackFrame, position string, iterable Value) error {
+	if dictValue, okDict := iterable.(DictValue); okDict {
+		next, okNext := dictValue.val["next"]
+		close, okClose := dictValue.val["close"]
+		if okNext && okClose && isFunction(*next) && isFunction(*close) {
+			_, err := callFunction(frame, position, *close, []Value{})
+			return err
+		}
+	}
+	return nil
+}
+
+// Call `callback` for each key and value of an iterable. The iterator is
+// closed if the callback stops early with an error, a break, or a return.
+// An error from closing it replaces a break or return, but not an error
+func iterate(frame *StackFrame, position string, iterable Value, callback func(Value, Value) error) error {
+	next, err := getIterator(frame, position, iterable)
+	if err != nil {
+		return err
+	}
+	for {
+		key, value, done, err := next()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		err = callback(key, value)
+		if err != nil {
+			if closeErr := closeIterator(frame, position, iterable); closeErr != nil && isControlFlow(err) {
+				return closeErr
+			}
+			return err
+		}
+	}
+}
+
+// Declare the loop variables in the current scope (never a parent's)
+func bindForIn(frame *StackFrame, forIn *ForIn, iterable Value, key Value, value Value) {
+	if forIn.Value != nil {
+		frame.declare(*forIn.Key, key)
+		frame.declare(*forIn.Value, value)
+		return
+	}
+	frame.declare(*forIn.Key, iterationItem(iterable, key, value))
+}
+
+func evalForIn(forFrame *StackFrame, position string, label *string, forIn *ForIn, block []*Statement) (Value, error) {
+	iterable, err := forIn.Iterable.Eval(forFrame)
+	if err != nil {
+		return nil, err
+	}
+	iterable, err = unwrap(iterable, forFrame)
+	if err != nil {
+		return nil, err
+	}
+	err = iterate(forFrame, forIn.Iterable.Pos.String(), iterable, func(key Value, value Value) error {
+		if stop := forFrame.runtime.step(); stop != nil {
+			return stop.at(forFrame, position)
+		}
+		bindForIn(forFrame, forIn, iterable, key, value)
+		hoistFunctions(forFrame, block)
+		for _, statement := range block {
+			_, err := statement.Eval(forFrame)
+			if err != nil {
+				if contErr, okCont := err.(ContinueError); okCont && isLoopTarget(label, contErr.label) {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if breakErr, okBreak := err.(BreakError); okBreak && isLoopTarget(label, breakErr.label) {
+		return UndefinedValue{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return UndefinedValue{}, nil
+}
+
+// Wrap a Go function as an iterator dict
+func newIteratorValue(next func() (Value, bool, error)) DictValue {
+	iteratorValue := newDictValue(0)
+	iteratorValue.Set("next", NativeFunctionValue{name: "next", Exec: func(frame *StackFrame, position string, args []Value) (Value, error) {
+		if len(args) != 0 {
+			return nil, traceError(frame, position, "next: takes no arguments")
+		}
+		value, done, err := next()
+		if err != nil {
+			return nil, err
+		}
+		result := newDictValue(0)
+		result.Set("value", value)
+		result.Set("done", BoolValue{val: done})
+		return result, nil
+	}})
+	return iteratorValue
+}
+
+// A native `close` function for an iterator dict
+func closeFunction(close func()) NativeFunctionValue {
+	return NativeFunctionValue{name: "close", Exec: func(frame *StackFrame, position string, args []Value) (Value, error) {
+		if len(args) != 0 {
+			return nil, traceError(frame, position, "close: takes no arguments")
+		}
+		close()
+		return UndefinedValue{}, nil
+	}}
+}
+
+// An open file that's read a line at a time
+type lineReader struct {
+	runtime *runtimeState
+	file    fs.File
+	scanner *bufio.Scanner
+	closed  bool
+}
+
+func (reader *lineReader) close() {
+	if !reader.closed {
+		reader.closed = true
+		reader.file.Close()
+		reader.runtime.release(reader)
+	}
+}
+
+// The file is closed once every line has been read, when `close()` is
+// called e.g. by a loop that breaks, or when the run ends
+func newLineIterator(frame *StackFrame, position string, path string, file fs.File) DictValue {
+	reader := &lineReader{runtime: frame.runtime, file: file, scanner: bufio.NewScanner(file)}
+	frame.runtime.acquire(reader)
+	iteratorValue := newIteratorValue(func() (Value, bool, error) {
+		if reader.closed {
+			return UndefinedValue{}, true, nil
+		}
+		if stop := frame.runtime.cancelled(); stop != nil {
+			reader.close()
+			return nil, false, stop.at(frame, position)
+		}
+		if reader.scanner.Scan() {
+			return StringValue{val: []byte(reader.scanner.Text())}, false, nil
+		}
+		reader.close()
+		if err := reader.scanner.Err(); err != nil {
+			return nil, false, traceError(frame, position,
+				fmt.Sprintf("read_lines: while reading %v: %v", path, err))
+		}
+		return UndefinedValue{}, true, nil
+	})
+	iteratorValue.Set("close", closeFunction(reader.close))
+	return iteratorValue
+}
+
+// A generator's body runs on its own goroutine, taking turns with
+// the caller of `next` so that only one of them is ever running
+type generatorState struct {
+	runtime *runtimeState
+	// Receives false when the generator is closed before finishing
+	resume  chan bool
+	results chan generatorResult
+	// Closed once the goroutine has returned
+	finished chan struct{}
+	// Whether the body is running, rather than waiting to be resumed
+	running bool
+	done    bool
+}
+
+type generatorResult struct {
+	value Value
+	done  bool
+	err   error
+}
+
+// Unwinds a generator that will never be resumed
+type generatorAbandoned struct{}
+
+func (g generatorAbandoned) Error() string {
+	return "generator abandoned"
+}
+
+func newGenerator(callFrame *StackFrame, body func() (Value, error)) DictValue {
+	state := &generatorState{
+		runtime:  callFrame.runtime,
+		resume:   make(chan bool, 1),
+		results:  make(chan generatorResult),
+		finished: make(chan struct{}),
+	}
+	callFrame.generator = state
+	callFrame.runtime.acquire(state)
+	go func() {
+		defer close(state.finished)
+		if !<-state.resume {
+			return
+		}
+		value, err := body()
+		if tail, okTail := value.(tailCall); okTail && err == nil {
+			value, err = tail.function.Exec(tail.position, tail.args)
+		}
+		if _, okAbandoned := err.(generatorAbandoned); okAbandoned {
+			// Unless it closed itself, nothing is waiting for a result
+			if !state.running {
+				return
+			}
+			value, err = UndefinedValue{}, nil
+		}
+		state.results <- generatorResult{value: value, done: true, err: err}
+	}()
+
+	iteratorValue := newIteratorValue(func() (Value, bool, error) {
+		if state.done {
+			return UndefinedValue{}, true, nil
+		}
+		state.running = true
+		state.resume <- true
+		result := <-state.results
+		state.running = false
+		if result.done && !state.done {
+			state.done = true
+			state.runtime.release(state)
+		}
+		if result.err != nil {
+			return nil, false, result.err
+		}
+		return result.value, result.done, nil
+	})
+	iteratorValue.Set("close", closeFunction(state.close))
+	return iteratorValue
+}
+
+// Unwind a generator that hasn't finished and wait for its goroutine to
+// return. A generator that closes itself stops at its next `yield`
+func (state *generatorState) close() {
+	if state.done {
+		return
+	}
+	state.done = true
+	state.runtime.release(state)
+	if state.running {
+		return
+	}
+	state.resume <- false
+	<-state.finished
+}
+
+// Hand a value to the caller of `next` and wait to be resumed
+func yieldValue(frame *StackFrame, position string, value Value) (Value, error) {
+	for generatorFrame := frame; generatorFrame != nil; generatorFrame = generatorFrame.parent {
+		if state := generatorFrame.generator; state != nil {
+			if state.done {
+				return nil, generatorAbandoned{}
+			}
+			state.results <- generatorResult{value: value}
+			if !<-state.resume {
+				return nil, generatorAbandoned{}
+			}
+			return UndefinedValue{}, nil
+		}
+	}
+	return nil, traceError(frame, position, "yield used outside of a function")
+}
+
+// Whether a function body yields (not counting nested functions)
+func containsYield(statements []*Statement) bool {
+	for _, statement := range statements {
+		if statement.Yield != nil {
+			return true
+		}
+		if statement.If != nil && (containsYield(statement.If.If) || containsYield(statement.If.Else)) {
+			return true
+		}
+		if statement.For != nil && containsYield(statement.For.Block) {
+			return true
+		}
+		if statement.While != nil && containsYield(statement.While.Block) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package adventlang
+
+import (
+	"io/fs"
+	"sync/atomic"
+	"testing"
+)
+
+// Counts the files that are still open
+type trackingFS struct {
+	fs.FS
+	open *int32
+}
+
+type trackedFile struct {
+	fs.File
+	open *int32
+}
+
+func (tracking trackingFS) Open(name string) (fs.File, error) {
+	file, err := tracking.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(tracking.open, 1)
+	return trackedFile{File: file, open: tracking.open}, nil
+}
+
+func (file trackedFile) Close() error {
+	atomic.AddInt32(file.open, -1)
+	return file.File.Close()
+}
+
+func TestReadLinesClose(t *testing.T) {
+	open := int32(0)
+	source := `let lines = read_lines("a.txt"); lines.next(); lines.close(); lines.next().done;`
+	result, _, err := RunProgramWithOptions("main.adv", source,
+		Options{FS: trackingFS{FS: MemoryFS{"a.txt": "a\nb\n"}, open: &open}})
+	if err != nil || result != "true" {
+		t.Fatalf("got %q, %v, wanted true", result, err)
+	}
+	if atomic.LoadInt32(&open) != 0 {
+		t.Fatalf("the file wasn't closed")
+	}
+}
+
+// Loops close the iterators they stop early, so files are closed
+// before the run ends
+func TestLoopsCloseIterators(t *testing.T) {
+	tests := []struct {
+		source  string
+		failing bool
+	}{
+		{source: `for (line in read_lines("a.txt")) { break; }`},
+		{source: `let f = func() { for (line in read_lines("a.txt")) { return line; } }; f();`},
+		{source: `let g = func(x) { return x; }; let f = func() { for (line in read_lines("a.txt")) { return g(line); } }; f();`},
+		{source: `outer: for (x in [1, 2]) { for (line in read_lines("a.txt")) { continue outer; } }`},
+		{source: `let lines = func() { for (line in read_lines("a.txt")) { yield line; } }; for (line in lines()) { break; }`},
+		{source: `for (line in read_lines("a.txt")) { missing(); }`, failing: true},
+		{source: `[assert(line, "b") for (line in read_lines("a.txt"))];`, failing: true},
+	}
+	for _, treeWalker := range []bool{false, true} {
+		for _, test := range tests {
+			open := int32(0)
+			interpreter := NewInterpreter(InterpreterOptions{Options: Options{
+				FS: trackingFS{FS: MemoryFS{"a.txt": "a\nb\n"}, open: &open}, TreeWalker: treeWalker}})
+			_, err := interpreter.Eval(test.source)
+			if (err != nil) != test.failing {
+				t.Fatalf("%v: got error %v", test.source, err)
+			}
+			if atomic.LoadInt32(&open) != 0 {
+				t.Fatalf("%v: the file wasn't closed (tree walker: %v)", test.source, treeWalker)
+			}
+		}
+	}
+}
+
+func TestRunClosesIterators(t *testing.T) {
+	open := int32(0)
+	source := `
+let lines = read_lines("a.txt");
+lines.next();
+let gen = func() { for (line in read_lines("a.txt")) { yield line; } };
+let suspended = gen();
+suspended.next();`
+	_, _, err := RunProgramWithOptions("main.adv", source,
+		Options{FS: trackingFS{FS: MemoryFS{"a.txt": "a\nb\n"}, open: &open}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&open) != 0 {
+		t.Fatalf("the files weren't closed when the run ended")
+	}
+}
+
+func TestInterpreterClose(t *testing.T) {
+	open := int32(0)
+	interpreter := NewInterpreter(InterpreterOptions{Options: Options{
+		FS: trackingFS{FS: MemoryFS{"a.txt": "a\nb\n"}, open: &open}}})
+	if _, err := interpreter.Eval(`let lines = read_lines("a.txt"); lines.next();`); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&open) != 1 {
+		t.Fatalf("the file was closed while a global still had its iterator")
+	}
+	interpreter.Close()
+	if atomic.LoadInt32(&open) != 0 {
+		t.Fatalf("the file wasn't closed")
+	}
+	done, err := interpreter.Eval(`lines.next().done;`)
+	if err != nil || done.String() != "true" {
+		t.Fatalf("got %v, %v, wanted true", done, err)
+	}
+}
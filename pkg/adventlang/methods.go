@@ -0,0 +1,227 @@
+package adventlang
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Methods are looked up by the receiver's type name and called with the
+// receiver as their first argument e.g. `"a,b".split(",")` is `split("a,b", ",")`.
+// Class instances look up their class name before "dict"
+type methodTable map[string]map[string]Value
+
+var (
+	builtinMethodsLock sync.RWMutex
+	builtinMethods     = make(methodTable)
+)
+
+func init() {
+	RegisterMethod("list", "append", doAppend)
+	RegisterMethod("list", "prepend", doPrepend)
+	RegisterMethod("list", "pop", doPop)
+	RegisterMethod("list", "prepop", doPrepop)
+	RegisterMethod("list", "popat", doPopat)
+	RegisterMethod("list", "len", doLen)
+	RegisterMethod("list", "join", doJoin)
+
+	RegisterMethod("string", "len", doLen)
+	RegisterMethod("string", "split", doSplit)
+	RegisterMethod("string", "trim", doTrim)
+	RegisterMethod("string", "upper", doUpper)
+	RegisterMethod("string", "lower", doLower)
+	RegisterMethod("string", "contains", doContains)
+
+	RegisterMethod("dict", "len", doLen)
+	RegisterMethod("dict", "keys", doKeys)
+	RegisterMethod("dict", "values", doValues)
+	RegisterMethod("dict", "delete", doDelete)
+	RegisterMethod("dict", "get", doGet)
+	RegisterMethod("dict", "has", doHas)
+
+	RegisterMethod("number", "floor", doFloor)
+	RegisterMethod("number", "str", doStr)
+}
+
+// Add a native method for every program e.g. `RegisterMethod("string", "shout", doShout)`.
+// The receiver is passed as the first argument
+func RegisterMethod(typeName string, name string, exec func(*StackFrame, string, []Value) (Value, error)) {
+	builtinMethodsLock.Lock()
+	defer builtinMethodsLock.Unlock()
+	if _, ok := builtinMethods[typeName]; !ok {
+		builtinMethods[typeName] = make(map[string]Value)
+	}
+	builtinMethods[typeName][name] = NativeFunctionValue{name: name, Exec: exec}
+}
+
+func (runtime *runtimeState) lookupMethod(receiver Value, name string) (Value, bool) {
+	typeNames := []string{typeName(receiver)}
+	if dictValue, okDict := receiver.(DictValue); okDict && dictValue.class != nil {
+		typeNames = append(typeNames, "dict")
+	}
+	for _, typeName := range typeNames {
+		if method, ok := runtime.methods[typeName][name]; ok {
+			return method, true
+		}
+		builtinMethodsLock.RLock()
+		method, ok := builtinMethods[typeName][name]
+		builtinMethodsLock.RUnlock()
+		if ok {
+			return method, true
+		}
+	}
+	return nil, false
+}
+
+// A method bound to its receiver can be called or passed around like any function
+func bindMethod(receiver Value, name string, method Value) Value {
+	return NativeFunctionValue{name: name, Exec: func(frame *StackFrame, position string, args []Value) (Value, error) {
+		return callFunction(frame, position, method, append([]Value{receiver}, args...))
+	}}
+}
+
+// Register a method from a program e.g. `method("list", "sum", func(l) { ... })`
+func doMethod(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 3 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("method: incorrect number of arguments, wanted: 3, got: %v", len(args)))
+	}
+	typeValue, okType := args[0].(StringValue)
+	nameValue, okName := args[1].(StringValue)
+	if !okType || !okName || !isFunction(args[2]) {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("method: expects arguments of type [string, string, function], got: [%v, %v, %v]",
+				typeName(args[0]), typeName(args[1]), typeName(args[2])))
+	}
+	methods := frame.runtime.methods
+	if _, ok := methods[typeValue.String()]; !ok {
+		methods[typeValue.String()] = make(map[string]Value)
+	}
+	methods[typeValue.String()][nameValue.String()] = args[2]
+	return UndefinedValue{}, nil
+}
+
+func doSplit(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 2 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("split: incorrect number of arguments, wanted: 2, got: %v", len(args)))
+	}
+	strValue, okStr := args[0].(StringValue)
+	sepValue, okSep := args[1].(StringValue)
+	if !okStr || !okSep {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("split: expects arguments of type [string, string], got: [%v, %v]",
+				typeName(args[0]), typeName(args[1])))
+	}
+	parts := strings.Split(strValue.String(), sepValue.String())
+	if limit := frame.runtime.allocate(len(strValue.val) + len(parts)*listItemSize); limit != nil {
+		return nil, limit.at(frame, position)
+	}
+	listValue := newListValue(0)
+	for _, part := range parts {
+		listValue.Append(StringValue{val: []byte(part)})
+	}
+	return listValue, nil
+}
+
+// `l.join(sep)` joins the items of a list as `str` would write them
+func doJoin(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 2 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("join: incorrect number of arguments, wanted: 2, got: %v", len(args)))
+	}
+	listValue, okList := args[0].(ListValue)
+	sepValue, okSep := args[1].(StringValue)
+	if !okList || !okSep {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("join: expects arguments of type [list, string], got: [%v, %v]",
+				typeName(args[0]), typeName(args[1])))
+	}
+	parts := make([]string, 0, len(listValue.val))
+	size := 0
+	for _, item := range listValue.val {
+		part, err := doStr(frame, position, []Value{unref(*item)})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part.String())
+		size += len(parts[len(parts)-1]) + len(sepValue.val)
+	}
+	if limit := frame.runtime.allocate(size); limit != nil {
+		return nil, limit.at(frame, position)
+	}
+	return StringValue{val: []byte(strings.Join(parts, sepValue.String()))}, nil
+}
+
+// Apply a Go string function to a single string argument
+func mapString(name string, f func(string) string) func(*StackFrame, string, []Value) (Value, error) {
+	return func(frame *StackFrame, position string, args []Value) (Value, error) {
+		if len(args) != 1 {
+			return nil, traceError(frame, position,
+				fmt.Sprintf("%v: incorrect number of arguments, wanted: 1, got: %v", name, len(args)))
+		}
+		strValue, okStr := args[0].(StringValue)
+		if !okStr {
+			return nil, traceError(frame, position,
+				fmt.Sprintf("%v: expects a single argument of type string, got: %v", name, typeName(args[0])))
+		}
+		return StringValue{val: []byte(f(strValue.String()))}, nil
+	}
+}
+
+var (
+	doTrim  = mapString("trim", strings.TrimSpace)
+	doUpper = mapString("upper", strings.ToUpper)
+	doLower = mapString("lower", strings.ToLower)
+)
+
+func doContains(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 2 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("contains: incorrect number of arguments, wanted: 2, got: %v", len(args)))
+	}
+	strValue, okStr := args[0].(StringValue)
+	subValue, okSub := args[1].(StringValue)
+	if !okStr || !okSub {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("contains: expects arguments of type [string, string], got: [%v, %v]",
+				typeName(args[0]), typeName(args[1])))
+	}
+	return BoolValue{val: strings.Contains(strValue.String(), subValue.String())}, nil
+}
+
+// `d.get(key)` or `d.get(key, default)` reads a key without inserting it
+func doGet(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("get: incorrect number of arguments, wanted: 2 or 3, got: %v", len(args)))
+	}
+	dictValue, okDict := args[0].(DictValue)
+	keyValue, okKey := args[1].(StringValue)
+	if !okDict || !okKey {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("get: expects a dict and a string key, got: [%v, %v]", typeName(args[0]), typeName(args[1])))
+	}
+	if value, err := dictValue.Get(keyValue.String()); err == nil {
+		return itemOf(dictValue.isFrozen(), *value), nil
+	}
+	if len(args) == 3 {
+		return args[2], nil
+	}
+	return UndefinedValue{}, nil
+}
+
+func doHas(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 2 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("has: incorrect number of arguments, wanted: 2, got: %v", len(args)))
+	}
+	dictValue, okDict := args[0].(DictValue)
+	keyValue, okKey := args[1].(StringValue)
+	if !okDict || !okKey {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("has: expects a dict and a string key, got: [%v, %v]", typeName(args[0]), typeName(args[1])))
+	}
+	_, err := dictValue.Get(keyValue.String())
+	return BoolValue{val: err == nil}, nil
+}
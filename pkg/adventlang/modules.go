@@ -0,0 +1,160 @@
+package adventlang
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/healeycodes/adventlang/lib"
+)
+
+// A module runs once, the first time it's imported. Every import after that
+// gets the same dict of its exports, which are the top-level variables that
+// it declared whose names don't start with `_`. Builtins aren't exported
+// unless the module declared its own
+
+type module struct {
+	exports DictValue
+	// Set while the module runs, so that importing it again is a cycle
+	loading bool
+}
+
+// The modules of a program by their canonical paths, and the chain of
+// modules that are running
+type moduleCache struct {
+	modules map[string]*module
+	chain   []string
+}
+
+func (runtime *runtimeState) importModule(frame *StackFrame, position string, specifier string) (Value, error) {
+	filename, key, read := runtime.findModule(frame.filename, specifier)
+	if module, okModule := runtime.modules.modules[key]; okModule {
+		if module.loading {
+			return nil, traceError(frame, position,
+				"import: cycle: "+strings.Join(runtime.cycle(key, filename), " -> "))
+		}
+		return module.exports, nil
+	}
+
+	source, err := read()
+	if err != nil {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("import: while reading %v: %v", filename, err))
+	}
+	module := &module{loading: true}
+	runtime.enterModule(key, filename, module)
+	_, context, err := runProgram(filename, string(source), runtime)
+	runtime.exitModule()
+	if err != nil {
+		// It can be imported again, e.g. once the file has been fixed
+		delete(runtime.modules.modules, key)
+		return nil, err
+	}
+
+	builtins := Context{}
+	builtins.Init(filename)
+	InjectRuntime(&builtins)
+	module.exports = newDictValue(0)
+	for id, value := range context.stackFrame.variables() {
+		if !strings.HasPrefix(id, "_") && !isBuiltin(&builtins.stackFrame, id, value) {
+			module.exports.Set(id, value)
+		}
+	}
+	// Importers can't change a module, or anything in it, for everyone
+	// else. The module's own functions still can
+	*module.exports.frozen = true
+	module.loading = false
+	return module.exports, nil
+}
+
+// Whether a variable is still the builtin that InjectRuntime declared
+func isBuiltin(builtins *StackFrame, name string, value Value) bool {
+	nativeFunctionValue, okNative := value.(NativeFunctionValue)
+	builtin := builtins.local(name)
+	if !okNative || builtin == nil {
+		return false
+	}
+	builtinValue, okBuiltin := (*builtin).(NativeFunctionValue)
+	return okBuiltin &&
+		reflect.ValueOf(nativeFunctionValue.Exec).Pointer() == reflect.ValueOf(builtinValue.Exec).Pointer()
+}
+
+func (runtime *runtimeState) enterModule(key string, filename string, entry *module) {
+	if runtime.modules.modules == nil {
+		runtime.modules.modules = make(map[string]*module)
+	}
+	runtime.modules.modules[key] = entry
+	runtime.modules.chain = append(runtime.modules.chain, filename)
+}
+
+func (runtime *runtimeState) exitModule() {
+	runtime.modules.chain = runtime.modules.chain[:len(runtime.modules.chain)-1]
+}
+
+// The files of an import cycle, from the module that's imported again
+func (runtime *runtimeState) cycle(key string, filename string) []string {
+	chain := runtime.modules.chain
+	for i, importer := range chain {
+		if runtime.canonicalPath(importer) == key {
+			return append(append([]string{}, chain[i:]...), filename)
+		}
+	}
+	return append(append([]string{}, chain...), filename)
+}
+
+// Where an import's source is, its canonical path, and a function that
+// reads it. `std/` imports are the embedded standard library, where the .adv
+// extension is optional. Other paths that aren't relative to the importing
+// file are looked for at the root of the filesystem, then in each directory
+// of the module path
+func (runtime *runtimeState) findModule(importer string, specifier string) (string, string, func() ([]byte, error)) {
+	if strings.HasPrefix(specifier, "std/") {
+		name := path.Clean(strings.TrimPrefix(specifier, "std/"))
+		if path.Ext(name) == "" {
+			name += ".adv"
+		}
+		return "std/" + name, "std:" + name, func() ([]byte, error) {
+			return fs.ReadFile(lib.FS, name)
+		}
+	}
+	filename := resolveImport(importer, specifier)
+	if _, err := fs.Stat(runtime.fs, filename); err != nil && !isRelativeImport(specifier) {
+		for _, dir := range runtime.modulePath {
+			candidate := path.Join(filepath.ToSlash(dir), filename)
+			if _, err := fs.Stat(runtime.fs, candidate); err == nil {
+				filename = candidate
+				break
+			}
+		}
+	}
+	return filename, runtime.canonicalPath(filename), func() ([]byte, error) {
+		return fs.ReadFile(runtime.fs, filename)
+	}
+}
+
+func isRelativeImport(specifier string) bool {
+	return strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../")
+}
+
+// Paths starting with ./ or ../ are relative to the importing file, others
+// are relative to the root of the filesystem e.g. the working directory
+func resolveImport(importer string, specifier string) string {
+	if isRelativeImport(specifier) {
+		return path.Join(path.Dir(filepath.ToSlash(importer)), specifier)
+	}
+	return path.Clean(specifier)
+}
+
+// The same file has one canonical path however it's imported. On the host
+// that's its absolute path
+func (runtime *runtimeState) canonicalPath(filename string) string {
+	if _, okOS := runtime.fs.(OSFS); okOS {
+		if absolute, err := filepath.Abs(filepath.FromSlash(filename)); err == nil {
+			return absolute
+		}
+	}
+	return path.Clean(filepath.ToSlash(filename))
+}
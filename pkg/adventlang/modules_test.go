@@ -0,0 +1,29 @@
+package adventlang
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModuleExports(t *testing.T) {
+	files := MemoryFS{"lib.adv": `let x = 1; let _hidden = 2; let len = func(l) { return 0; };`}
+	result, _, err := RunProgramWithOptions("main.adv", `let lib = import("./lib.adv"); [len(keys(lib)), lib.has("x"), lib.has("len"), lib.has("print")];`, Options{FS: files})
+	if err != nil || result != "[2, true, true, false]" {
+		t.Fatalf("got %q, %v, wanted the names that lib.adv declared", result, err)
+	}
+}
+
+func TestModuleCycle(t *testing.T) {
+	files := MemoryFS{
+		"a.adv": `import("./b.adv");`,
+		"b.adv": `import("./c.adv");`,
+		"c.adv": `import("./a.adv");`,
+	}
+	for _, treeWalker := range []bool{false, true} {
+		_, _, err := RunProgramWithOptions("main.adv", `import("./a.adv");`, Options{FS: files, TreeWalker: treeWalker})
+		want := "c.adv:1:7: import: cycle: a.adv -> b.adv -> c.adv -> a.adv"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("got %v, wanted %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package adventlang
+
+import (
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Before a program runs, its syntax tree is optimised in place. Literals are
+// decoded into values, arithmetic and string concatenation between constants
+// is folded, and the branches of `if (true)` and `if (false)` that can't run
+// are removed. Operations that fail aren't folded, so errors are still
+// reported when (and where) the program runs into them
+
+type optimiser struct{}
+
+func optimise(program *Program) {
+	program.Statements = optimiser{}.block(program.Statements)
+}
+
+// A block's value is its last statement's, so that one is always kept
+func (o optimiser) block(statements []*Statement) []*Statement {
+	kept := statements[:0]
+	for i, statement := range statements {
+		o.statement(statement)
+		if ifStatement := statement.If; ifStatement != nil && i != len(statements)-1 &&
+			len(ifStatement.If) == 0 && len(ifStatement.Else) == 0 && o.isBool(ifStatement.Condition) {
+			continue
+		}
+		kept = append(kept, statement)
+	}
+	return kept
+}
+
+func (o optimiser) statement(statement *Statement) {
+	switch {
+	case statement.If != nil:
+		ifStatement := statement.If
+		condition := o.expr(ifStatement.Condition)
+		if boolValue, okBool := condition.(BoolValue); okBool {
+			if boolValue.val {
+				ifStatement.Else = nil
+			} else {
+				ifStatement.If = nil
+			}
+		}
+		ifStatement.If = o.block(ifStatement.If)
+		ifStatement.Else = o.block(ifStatement.Else)
+	case statement.For != nil:
+		forStatement := statement.For
+		if forStatement.ForIn != nil {
+			o.expr(forStatement.ForIn.Iterable)
+		}
+		o.optionalExpr(forStatement.Init)
+		o.optionalExpr(forStatement.Condition)
+		o.optionalExpr(forStatement.Post)
+		forStatement.Block = o.block(forStatement.Block)
+	case statement.While != nil:
+		o.optionalExpr(statement.While.Condition)
+		statement.While.Block = o.block(statement.While.Block)
+	case statement.Class != nil:
+		for _, member := range statement.Class.Members {
+			o.expr(member.Value)
+		}
+	case statement.Func != nil:
+		statement.Func.Block = o.block(statement.Func.Block)
+	case statement.Return != nil:
+		o.optionalExpr(statement.Return.Expr)
+	case statement.Yield != nil:
+		o.optionalExpr(statement.Yield.Expr)
+	case statement.Expr != nil:
+		o.expr(statement.Expr)
+	}
+}
+
+func (o optimiser) isBool(expr *Expr) bool {
+	_, okBool := expr.Assignment.constant().(BoolValue)
+	return okBool
+}
+
+func (o optimiser) optionalExpr(expr *Expr) {
+	if expr != nil {
+		o.expr(expr)
+	}
+}
+
+// Each level returns its constant value, or nil if it isn't constant
+func (o optimiser) expr(expr *Expr) Value {
+	return o.assignment(expr.Assignment)
+}
+
+func (o optimiser) assignment(assignment *Assignment) Value {
+	if assignment.Declared != nil {
+		o.ternary(assignment.Declared)
+	}
+	if assignment.Ternary != nil {
+		o.ternary(assignment.Ternary)
+	}
+	if assignment.Next != nil {
+		o.assignment(assignment.Next)
+	}
+	return assignment.constant()
+}
+
+func (o optimiser) ternary(ternary *Ternary) Value {
+	value := o.nullish(ternary.Nullish)
+	if ternary.Op != nil {
+		o.ternary(ternary.Then)
+		o.ternary(ternary.Else)
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) nullish(nullish *Nullish) Value {
+	value := o.pipeline(nullish.Pipeline)
+	if nullish.Op != nil {
+		o.nullish(nullish.Next)
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) pipeline(pipeline *Pipeline) Value {
+	value := o.logicOr(pipeline.LogicOr)
+	for _, stage := range pipeline.Stages {
+		o.primary(stage)
+	}
+	if len(pipeline.Stages) > 0 {
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) logicOr(logicOr *LogicOr) Value {
+	value := o.logicAnd(logicOr.LogicAnd)
+	if logicOr.Op != nil {
+		o.logicOr(logicOr.Next)
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) logicAnd(logicAnd *LogicAnd) Value {
+	value := o.equality(logicAnd.Equality)
+	if logicAnd.Op != nil {
+		o.logicAnd(logicAnd.Next)
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) equality(equality *Equality) Value {
+	value := o.comparison(equality.Comparison)
+	if equality.Op != nil {
+		o.equality(equality.Next)
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) comparison(comparison *Comparison) Value {
+	value := o.bitwiseOr(comparison.BitwiseOr)
+	if comparison.Op != nil {
+		o.comparison(comparison.Next)
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) bitwiseOr(bitwiseOr *BitwiseOr) Value {
+	value := o.bitwiseXor(bitwiseOr.BitwiseXor)
+	for _, op := range bitwiseOr.Ops {
+		o.bitwiseXor(op.Next)
+	}
+	if len(bitwiseOr.Ops) > 0 {
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) bitwiseXor(bitwiseXor *BitwiseXor) Value {
+	value := o.bitwiseAnd(bitwiseXor.BitwiseAnd)
+	for _, op := range bitwiseXor.Ops {
+		o.bitwiseAnd(op.Next)
+	}
+	if len(bitwiseXor.Ops) > 0 {
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) bitwiseAnd(bitwiseAnd *BitwiseAnd) Value {
+	value := o.shift(bitwiseAnd.Shift)
+	for _, op := range bitwiseAnd.Ops {
+		o.shift(op.Next)
+	}
+	if len(bitwiseAnd.Ops) > 0 {
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) shift(shift *Shift) Value {
+	value := o.addition(shift.Addition)
+	for _, op := range shift.Ops {
+		o.addition(op.Next)
+	}
+	if len(shift.Ops) > 0 {
+		return nil
+	}
+	return value
+}
+
+// Only constants at the start of a chain can be folded, as the operators
+// group left to right
+func (o optimiser) addition(addition *Addition) Value {
+	value := o.multiplication(addition.Multiplication)
+	folded := 0
+	for i, op := range addition.Ops {
+		right := o.multiplication(op.Next)
+		if value != nil && folded == i {
+			if result := foldAddition(op.Op, value, right); result != nil {
+				value, folded = result, folded+1
+			}
+		}
+	}
+	if folded > 0 {
+		position := addition.Multiplication.Pos
+		addition.Multiplication = &Multiplication{Pos: position, Unary: literalUnary(position, value)}
+		addition.Ops = addition.Ops[folded:]
+	}
+	if len(addition.Ops) > 0 {
+		return nil
+	}
+	return value
+}
+
+func foldAddition(op string, left Value, right Value) Value {
+	leftStr, okLeft := left.(StringValue)
+	rightStr, okRight := right.(StringValue)
+	if isNumber(left) && isNumber(right) {
+		value, _ := evalAddition(nil, "", op, left, right)
+		return value
+	} else if op == "+" && okLeft && okRight {
+		return StringValue{val: append(append([]byte{}, leftStr.val...), rightStr.val...)}
+	}
+	return nil
+}
+
+func (o optimiser) multiplication(multiplication *Multiplication) Value {
+	value := o.unary(multiplication.Unary)
+	folded := 0
+	for i, op := range multiplication.Ops {
+		right := o.unary(op.Next)
+		if value != nil && folded == i {
+			if result := foldMultiplication(op.Op, value, right); result != nil {
+				value, folded = result, folded+1
+			}
+		}
+	}
+	if folded > 0 {
+		multiplication.Unary = literalUnary(multiplication.Unary.Pos, value)
+		multiplication.Ops = multiplication.Ops[folded:]
+	}
+	if len(multiplication.Ops) > 0 {
+		return nil
+	}
+	return value
+}
+
+func foldMultiplication(op string, left Value, right Value) Value {
+	if !isNumber(left) || !isNumber(right) {
+		return nil
+	}
+	// e.g. division by zero for `~/` and `%`
+	value, err := evalMultiplication(&StackFrame{}, "", op, left, right)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+func (o optimiser) unary(unary *Unary) Value {
+	if unary.Op == nil {
+		return o.power(unary.Power)
+	}
+	value := o.unary(unary.Unary)
+	_, okBool := value.(BoolValue)
+	if !(*unary.Op == "-" && isNumber(value)) && !(*unary.Op == "!" && okBool) {
+		return nil
+	}
+	value, _ = evalUnary(nil, "", *unary.Op, value)
+	*unary = *literalUnary(unary.Pos, value)
+	return value
+}
+
+func (o optimiser) power(power *Power) Value {
+	left := o.primary(power.Primary)
+	if power.Op == nil {
+		return left
+	}
+	right := o.unary(power.Next)
+	if !isNumber(left) || !isNumber(right) {
+		return nil
+	}
+	value, _ := evalPower(nil, "", *power.Op, left, right)
+	power.Primary = &Primary{Pos: power.Primary.Pos, value: value}
+	power.Op, power.Next = nil, nil
+	return value
+}
+
+func (o optimiser) primary(primary *Primary) Value {
+	switch {
+	case primary.FuncLiteral != nil:
+		primary.FuncLiteral.Block = o.block(primary.FuncLiteral.Block)
+	case primary.ListLiteral != nil:
+		for _, item := range primary.ListLiteral.Items {
+			o.expr(item)
+		}
+		o.clauses(primary.ListLiteral.Clauses)
+	case primary.DictLiteral != nil:
+		for _, item := range primary.DictLiteral.Items {
+			if item.KeyExpr != nil {
+				o.expr(item.KeyExpr)
+			}
+			o.expr(item.ValueExpr)
+		}
+		o.clauses(primary.DictLiteral.Clauses)
+	case primary.Call != nil:
+		o.callChain(primary.Call.CallChain)
+	case primary.SubExpression != nil:
+		value := o.expr(primary.SubExpression.Expr)
+		if primary.SubExpression.CallChain != nil {
+			o.callChain(primary.SubExpression.CallChain)
+			return nil
+		}
+		if value != nil {
+			primary.SubExpression = nil
+			primary.value = value
+		}
+		return value
+	case primary.Number != nil:
+		primary.value = NumberValue{val: float64(*primary.Number)}
+	case primary.Str != nil:
+		primary.value = StringValue{val: []byte(*primary.Str)[1 : len(*primary.Str)-1]}
+	case primary.True != nil:
+		primary.value = BoolValue{val: true}
+	case primary.False != nil:
+		primary.value = BoolValue{val: false}
+	case primary.Undefined != nil:
+		primary.value = UndefinedValue{}
+	}
+	if primary.CallChain != nil {
+		o.callChain(primary.CallChain)
+		return nil
+	}
+	return primary.value
+}
+
+func (o optimiser) callChain(callChain *CallChain) {
+	for link := callChain; link != nil; link = link.Next {
+		if link.Args != nil {
+			for _, expr := range link.Args.Exprs {
+				o.expr(expr)
+			}
+		}
+		if link.Index != nil {
+			o.expr(link.Index.Expr)
+		}
+	}
+}
+
+func (o optimiser) clauses(clauses []*ComprehensionClause) {
+	for _, clause := range clauses {
+		if clause.For != nil {
+			o.expr(clause.For.Iterable)
+		} else {
+			o.expr(clause.Condition)
+		}
+	}
+}
+
+func isNumber(value Value) bool {
+	_, okNumber := value.(NumberValue)
+	return okNumber
+}
+
+func literalUnary(position lexer.Position, value Value) *Unary {
+	return &Unary{Pos: position, Power: &Power{Pos: position, Primary: &Primary{Pos: position, value: value}}}
+}
+
+// The value of an optimised expression that's a lone constant
+func (assignment *Assignment) constant() Value {
+	if assignment.Let != nil || assignment.Op != nil {
+		return nil
+	}
+	primary := assignment.target().primary()
+	if primary == nil || primary.CallChain != nil {
+		return nil
+	}
+	return primary.value
+}
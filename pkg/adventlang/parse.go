@@ -1,6 +1,10 @@
 package adventlang
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
 )
@@ -17,10 +21,13 @@ type Statement struct {
 	If    *IfStatement    `@@`
 	For   *ForStatement   `| @@`
 	While *WhileStatement `| @@`
+	Class *ClassStatement `| @@`
+	Func  *FuncStatement  `| @@`
 	// These optional semi-colons could cause problems
-	Return   *ReturnStatement `| @@ ";"?`
-	Break    *string          `| @"break" ";"?`
-	Continue *string          `| @"continue" ";"?`
+	Return   *ReturnStatement   `| @@ ";"?`
+	Break    *BreakStatement    `| @@ ";"?`
+	Continue *ContinueStatement `| @@ ";"?`
+	Yield    *YieldStatement    `| @@ ";"?`
 	// --
 	Expr *Expr `| @@ ";"`
 }
@@ -33,22 +40,64 @@ type IfStatement struct {
 	Else      []*Statement `("else" "{" @@* "}")?`
 }
 
+// Loops can be labeled e.g. `outer: for (...) {}` so that nested loops
+// can `break outer;` or `continue outer;`
 type ForStatement struct {
 	Pos lexer.Position
 
-	Init      *Expr        `"for" "(" @@? ";"`
+	Label     *string      `( @Ident ":" )?`
+	ForIn     *ForIn       `"for" ( @@`
+	Init      *Expr        `| "(" @@? ";"`
 	Condition *Expr        `@@? ";"`
-	Post      *Expr        `@@? ")"`
+	Post      *Expr        `@@? ")" )`
 	Block     []*Statement `"{" @@* "}"`
 }
 
+// A class declares its members in order, functions become methods with a bound `self`
+// e.g. `class Point { x = 0; y = 0; to_string = func() { return str(self.x) }; }`
+type ClassStatement struct {
+	Pos lexer.Position
+
+	Name    string         `"class" @Ident`
+	Members []*ClassMember `"{" @@* "}"`
+}
+
+type ClassMember struct {
+	Pos lexer.Position
+
+	Name  string `@Ident "="`
+	Value *Expr  `@@ ";"`
+}
+
 type WhileStatement struct {
 	Pos lexer.Position
 
+	Label     *string      `( @Ident ":" )?`
 	Condition *Expr        `"while" "(" @@? ")"`
 	Block     []*Statement `"{" @@* "}"`
 }
 
+// A label is only read when it ends the statement, so that code after
+// a `break` on the next line isn't mistaken for a label
+type BreakStatement struct {
+	Pos lexer.Position
+
+	Label *string `"break" ( @Ident (?= ";" | "}") )?`
+}
+
+type ContinueStatement struct {
+	Pos lexer.Position
+
+	Label *string `"continue" ( @Ident (?= ";" | "}") )?`
+}
+
+// Any function containing a yield is a generator
+type YieldStatement struct {
+	Pos lexer.Position
+
+	Expr *Expr `"yield" @@?`
+}
+
 type ReturnStatement struct {
 	Pos lexer.Position
 
@@ -61,13 +110,49 @@ type Expr struct {
 	Assignment *Assignment `@@`
 }
 
+// Declarations can be annotated with a type e.g. `let x: number = 1`
 type Assignment struct {
 	Pos lexer.Position
 
-	Let     *string     `@"let"?`
-	LogicOr *LogicOr    `@@`
-	Op      *string     `( @"="`
-	Next    *Assignment `  @@ )?`
+	Let      *string     `( @( "let" | "const" )`
+	Declared *Ternary    `  @@`
+	Type     *TypeExpr   `  ( ":" @@ )?`
+	Ternary  *Ternary    `| @@ )`
+	Op       *string     `( @"="`
+	Next     *Assignment `  @@ )?`
+}
+
+// The expression being assigned to
+func (assignment Assignment) target() *Ternary {
+	if assignment.Declared != nil {
+		return assignment.Declared
+	}
+	return assignment.Ternary
+}
+
+type Ternary struct {
+	Pos lexer.Position
+
+	Nullish *Nullish `@@`
+	Op      *string  `( @"?"`
+	Then    *Ternary `  @@`
+	Else    *Ternary `  ":" @@ )?`
+}
+
+type Nullish struct {
+	Pos lexer.Position
+
+	Pipeline *Pipeline `@@`
+	Op       *string   `( @( "?" "?" )`
+	Next     *Nullish  `  @@ )?`
+}
+
+// `x |> f(a)` calls `f(x, a)` and `x |> f` calls `f(x)`
+type Pipeline struct {
+	Pos lexer.Position
+
+	LogicOr *LogicOr   `@@`
+	Stages  []*Primary `( "|" ">" @@ )*`
 }
 
 type LogicOr struct {
@@ -97,68 +182,241 @@ type Equality struct {
 type Comparison struct {
 	Pos lexer.Position
 
-	Addition *Addition   `@@`
-	Op       *string     `[ @( ">" "=" | ">" | "<" "=" | "<" )`
-	Next     *Comparison `  @@ ]`
+	BitwiseOr *BitwiseOr  `@@`
+	Op        *string     `[ @( ">" "=" | ">" | "<" "=" | "<" )`
+	Next      *Comparison `  @@ ]`
+}
+
+// The binary operators from here to Multiplication group left to right
+// e.g. `a - b - c` is `(a - b) - c`
+type BitwiseOr struct {
+	Pos lexer.Position
+
+	BitwiseXor *BitwiseXor    `@@`
+	Ops        []*BitwiseOrOp `@@*`
+}
+
+type BitwiseOrOp struct {
+	Op   string      `@"|"`
+	Next *BitwiseXor `@@`
+}
+
+type BitwiseXor struct {
+	Pos lexer.Position
+
+	BitwiseAnd *BitwiseAnd     `@@`
+	Ops        []*BitwiseXorOp `@@*`
+}
+
+type BitwiseXorOp struct {
+	Op   string      `@"^"`
+	Next *BitwiseAnd `@@`
+}
+
+type BitwiseAnd struct {
+	Pos lexer.Position
+
+	Shift *Shift          `@@`
+	Ops   []*BitwiseAndOp `@@*`
+}
+
+type BitwiseAndOp struct {
+	Op   string `@"&"`
+	Next *Shift `@@`
+}
+
+type Shift struct {
+	Pos lexer.Position
+
+	Addition *Addition  `@@`
+	Ops      []*ShiftOp `@@*`
+}
+
+type ShiftOp struct {
+	Op   string    `@( "<" "<" | ">" ">" )`
+	Next *Addition `@@`
 }
 
 type Addition struct {
 	Pos lexer.Position
 
 	Multiplication *Multiplication `@@`
-	Op             *string         `[ @( "-" | "+" )`
-	Next           *Addition       `  @@ ]`
+	Ops            []*AdditionOp   `@@*`
+}
+
+type AdditionOp struct {
+	Op   string          `@( "-" | "+" )`
+	Next *Multiplication `@@`
 }
 
 type Multiplication struct {
 	Pos lexer.Position
 
-	Unary *Unary          `@@`
-	Op    *string         `[ @( "/" | "*" | "%" )`
-	Next  *Multiplication `  @@ ]`
+	Unary *Unary              `@@`
+	Ops   []*MultiplicationOp `@@*`
+}
+
+type MultiplicationOp struct {
+	Op   string `@( "~/" | "/" | "*" | "%" )`
+	Next *Unary `@@`
 }
 
 type Unary struct {
 	Pos lexer.Position
 
-	Op      *string  `( @( "!" | "-" )`
-	Unary   *Unary   `  @@ )`
-	Primary *Primary `| @@`
+	Op    *string `( @( "!" | "-" | "~" )`
+	Unary *Unary  `  @@ )`
+	Power *Power  `| @@`
+}
+
+// Binds tighter than unary operators on its left e.g. `-2 ** 2` is -4
+type Power struct {
+	Pos lexer.Position
+
+	Primary *Primary `@@`
+	Op      *string  `[ @( "*" "*" )`
+	Next    *Unary   `  @@ ]`
 }
 
 type Primary struct {
 	Pos lexer.Position
 
-	FuncLiteral   *FuncLiteral   `@@`
+	FuncLiteral   *FuncLiteral   `( @@`
 	ListLiteral   *ListLiteral   `| @@`
 	DictLiteral   *DictLiteral   `| @@`
 	Call          *Call          `| @@`
 	SubExpression *SubExpression `| @@`
-	Number        *float64       `| ( @Float | @Int )`
+	Number        *Number        `| ( @Float | @Int )`
 	Str           *string        `| @String`
 	True          *bool          `| @"true"`
 	False         *bool          `| @"false"`
 	Undefined     *string        `| @"undefined"`
-	Ident         *string        `| @Ident`
+	Ident         *string        `| @Ident )`
+	// Literals can have methods called on them e.g. `"a,b".split(",")`
+	CallChain *CallChain `@@?`
+
+	// A literal or folded constant, set by the optimiser
+	value Value
+}
+
+// Number literals are decoded once while parsing
+// e.g. `1.5`, `1_000_000`, `0xff`, `0b1010`
+type Number float64
+
+func (number *Number) Capture(values []string) error {
+	literal := values[0]
+	if len(literal) > 1 && literal[0] == '0' && strings.ContainsAny(literal[1:2], "xXbB") {
+		n, err := strconv.ParseInt(literal, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number literal: %v", literal)
+		}
+		*number = Number(n)
+		return nil
+	}
+	if strings.HasPrefix(literal, "_") || strings.HasSuffix(literal, "_") ||
+		strings.Contains(literal, "__") || strings.Contains(literal, "_.") || strings.Contains(literal, "._") {
+		return fmt.Errorf("invalid number literal: %v", literal)
+	}
+	f, err := strconv.ParseFloat(strings.ReplaceAll(literal, "_", ""), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number literal: %v", literal)
+	}
+	*number = Number(f)
+	return nil
+}
+
+// Named functions are hoisted to the top of their block
+// e.g. `func is_even(n) { return n == 0 or is_odd(n - 1) }`
+type FuncStatement struct {
+	Pos lexer.Position
+
+	Name   string       `"func" @Ident`
+	Params []*Param     `"(" ( @@ ( "," @@ )* )? ")"`
+	Return *TypeExpr    `( "-" ">" @@ )?`
+	Block  []*Statement `"{" @@* "}"`
 }
 
 type FuncLiteral struct {
 	Pos lexer.Position
 
-	Params []string     `"func" "(" ( @Ident ( "," @Ident )* )? ")"`
+	Params []*Param     `"func" "(" ( @@ ( "," @@ )* )? ")"`
+	Return *TypeExpr    `( "-" ">" @@ )?`
 	Block  []*Statement `"{" @@* "}"`
 }
 
+// e.g. `x` or `xs: list<number>`
+type Param struct {
+	Pos lexer.Position
+
+	Name string    `@Ident`
+	Type *TypeExpr `( ":" @@ )?`
+}
+
+func paramNames(params []*Param) []string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = param.Name
+	}
+	return names
+}
+
+// A type annotation is a type name (or a class name), element types
+// for lists and dicts, and alternatives e.g. `list<number> | undefined`
+type TypeExpr struct {
+	Pos lexer.Position
+
+	Name   string      `@Ident`
+	Params []*TypeExpr `( "<" @@ ( "," @@ )* ">" )?`
+	Or     *TypeExpr   `( "|" @@ )?`
+}
+
+func (typeExpr *TypeExpr) String() string {
+	s := typeExpr.Name
+	if len(typeExpr.Params) > 0 {
+		params := make([]string, len(typeExpr.Params))
+		for i, param := range typeExpr.Params {
+			params[i] = param.String()
+		}
+		s += "<" + strings.Join(params, ", ") + ">"
+	}
+	if typeExpr.Or != nil {
+		s += " | " + typeExpr.Or.String()
+	}
+	return s
+}
+
+// With clauses, a list literal is a comprehension of its single item
+// e.g. `[x * 2 for (x in xs) if (x > 0)]`
 type ListLiteral struct {
 	Pos lexer.Position
 
-	Items []*Expr `"[" ( @@ ( "," @@ )* )? "]"`
+	Items   []*Expr                `"[" ( @@ ( "," @@ )* )?`
+	Clauses []*ComprehensionClause `@@* "]"`
 }
 
+// e.g. `{k: v * 2 for (k, v in d)}`
 type DictLiteral struct {
 	Pos lexer.Position
 
-	Items []*DictKV `"{" ( @@ ( "," @@ )* )? "}"`
+	Items   []*DictKV              `"{" ( @@ ( "," @@ )* )?`
+	Clauses []*ComprehensionClause `@@* "}"`
+}
+
+type ComprehensionClause struct {
+	Pos lexer.Position
+
+	For       *ForIn `"for" @@`
+	Condition *Expr  `| "if" @@`
+}
+
+// Binds the item, or the index/key and the item, of each iteration
+// e.g. `(x in xs)` or `(k, v in d)`
+type ForIn struct {
+	Pos lexer.Position
+
+	Key      *string `"(" @Ident`
+	Value    *string `( "," @Ident )?`
+	Iterable *Expr   `"in" @@ ")"`
 }
 
 type DictKV struct {
@@ -192,16 +450,20 @@ type CallChain struct {
 	Next     *CallChain    `@@?`
 }
 
+// Each link of a call chain can be optional e.g. `a?.b`, `a?.[0]`, `a?.()`
 type CallArgs struct {
-	Exprs []*Expr `"(" (@@ ("," @@)*)? ")"`
+	Optional *string `@( "?" "." )?`
+	Exprs    []*Expr `"(" (@@ ("," @@)*)? ")"`
 }
 
 type CallIndex struct {
-	Expr *Expr `"[" @@ "]"`
+	Optional *string `@( "?" "." )?`
+	Expr     *Expr   `"[" @@ "]"`
 }
 
 type CallProperty struct {
-	Ident *string `"." @Ident`
+	Optional *string `( @( "?" "." ) | "." )`
+	Ident    *string `@Ident`
 }
 
 var (
@@ -209,11 +471,13 @@ var (
 		{"comment", `//.*|/\*.*?\*/`, nil},
 		{"whitespace", `\s+`, nil},
 
-		{"Float", `([0-9]*[.])?[0-9]+`, nil},
-		{"Int", `[\d]+`, nil},
+		{"Int", `0[xX][0-9a-fA-F_]+|0[bB][01_]+`, nil},
+		{"Float", `(([0-9][0-9_]*)?[.])?[0-9][0-9_]*`, nil},
 		{"String", `"([^"]*)"`, nil},
 		{"Ident", `[\w]+`, nil},
-		{"Punct", `[-[!*%()+_={}\|:;"<,>./]|]`, nil},
+		// Integer division, `//` starts a comment
+		{"IntDiv", `~/`, nil},
+		{"Punct", `[-[!*%()+_={}\|:;"<,>./?^&~]|]`, nil},
 	})
 	parser = participle.MustBuild(&Program{},
 		participle.Lexer(lex),
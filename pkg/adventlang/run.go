@@ -1,36 +1,347 @@
 package adventlang
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
 	"os"
+	"strings"
+	"time"
 )
 
 const VERSION = 0.1
 
-func ReadProgram(filename string) string {
+// Read a program's source from the host's filesystem
+func ReadProgram(filename string) (string, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		println("while trying to read: ", filename, err.Error())
-		os.Exit(1)
+		return "", fmt.Errorf("while trying to read %v: %v", filename, err)
 	}
-	return string(b)
+	return string(b), nil
 }
 
-func RunProgram(filename string, source string) (string, *Context, error) {
-	program, err := GenerateAST(source)
-	if err != nil {
-		return "", nil, fmt.Errorf("\n%v:%v", filename, err.Error())
+// Function calls can nest this deep unless the options say otherwise
+const DefaultMaxRecursionDepth = 10000
+
+type Options struct {
+	// The number of nested function calls before a program fails with
+	// "maximum recursion depth exceeded". Calls in tail position don't
+	// count. Zero means DefaultMaxRecursionDepth. Every call uses some of
+	// Go's stack, so very high limits can crash instead
+	MaxRecursionDepth int
+	// Evaluate the syntax tree directly instead of compiling it to bytecode.
+	// The two should behave the same, this is for comparing them
+	TreeWalker bool
+	// Run the syntax tree as it's parsed, without folding constants and
+	// removing dead branches. The output should be the same either way
+	NoOptimise bool
+	// Stop the program with a LimitError once it has run this many
+	// statements and loop iterations. Zero means no limit
+	MaxSteps int
+	// Stop the program with a LimitError once it has run for this long.
+	// Zero means no limit
+	Timeout time.Duration
+	// Stop the program with a LimitError once it has allocated about this
+	// many bytes of lists, dicts, and strings. Memory isn't counted again
+	// when it's no longer used, so this is a budget for the whole run.
+	// Zero means no limit
+	MaxMemory int64
+	// Where programs write their output, os.Stdout and os.Stderr if nil
+	Stdout io.Writer
+	Stderr io.Writer
+	// If set, each line that a program prints is passed here instead of
+	// being written to Stdout or Stderr
+	LogSink func(LogEntry)
+	// The files that `import` and `read_lines` open, OSFS if nil
+	FS fs.FS
+	// Directories of FS where imports are looked for when they aren't
+	// found at its root. The CLI reads them from ADVENTLANG_PATH
+	ModulePath []string
+}
+
+// A line that a program printed, see Options.LogSink
+type LogEntry struct {
+	Time time.Time
+	// Where it was printed from e.g. "main.adv:3:1"
+	Position string
+	// "stdout" or "stderr"
+	Stream string
+	// Without the trailing newline
+	Line string
+}
+
+// The error of a program that exceeded one of its limits
+type LimitError struct {
+	// The limit of the Options that was exceeded: "steps", "timeout", or "memory"
+	Limit string
+	trace string
+}
+
+func (limitError LimitError) Error() string {
+	return limitError.trace
+}
+
+// The error of a program that was stopped because its context was
+// cancelled or its deadline passed. It wraps the context's error so
+// errors.Is(err, context.Canceled) works
+type CancelledError struct {
+	err   error
+	trace string
+}
+
+func (cancelledError CancelledError) Error() string {
+	return cancelledError.trace
+}
+
+func (cancelledError CancelledError) Unwrap() error {
+	return cancelledError.err
+}
+
+// Why a program is being stopped, either a LimitError or a CancelledError
+type interruption interface {
+	at(frame *StackFrame, position string) error
+}
+
+// Whether an error is a program being stopped, rather than failing
+func isInterruption(err error) bool {
+	switch err.(type) {
+	case LimitError, CancelledError:
+		return true
 	}
+	return false
+}
 
+// Approximate sizes for the memory limit, strings count their bytes
+const (
+	listItemSize  = 16
+	dictEntrySize = 64
+)
+
+// State that's shared by a program and the modules it imports
+type runtimeState struct {
+	// Registered with `method()`, these take precedence over builtin methods
+	methods methodTable
+	// The number of function calls in progress, not counting tail calls
+	depth    int
+	maxDepth int
+	// Whether programs and imported modules skip compiling to bytecode
+	treeWalker bool
+	// Whether they skip the optimiser
+	noOptimise bool
+	// Counted against the limits, see Options
+	steps     int
+	maxSteps  int
+	timeout   time.Duration
+	deadline  time.Time
+	allocated int64
+	maxMemory int64
+	// Closed when the program's context is cancelled, nil if it can't be
+	ctx  context.Context
+	done <-chan struct{}
+	// Imported modules, see modules.go
+	modules moduleCache
+	// See Options
+	stdout     io.Writer
+	stderr     io.Writer
+	logSink    func(LogEntry)
+	fs         fs.FS
+	modulePath []string
+	// Open files and unfinished generators, see iterators.go
+	resources map[resource]bool
+}
+
+// Something that's held until it's closed or the run ends
+type resource interface {
+	close()
+}
+
+func newRuntimeState(options Options) *runtimeState {
+	maxDepth := options.MaxRecursionDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxRecursionDepth
+	}
+	runtime := &runtimeState{methods: make(methodTable), maxDepth: maxDepth,
+		treeWalker: options.TreeWalker, noOptimise: options.NoOptimise,
+		maxSteps: options.MaxSteps, timeout: options.Timeout, maxMemory: options.MaxMemory,
+		stdout: options.Stdout, stderr: options.Stderr, logSink: options.LogSink,
+		fs: options.FS, modulePath: options.ModulePath}
+	if runtime.stdout == nil {
+		runtime.stdout = os.Stdout
+	}
+	if runtime.stderr == nil {
+		runtime.stderr = os.Stderr
+	}
+	if runtime.fs == nil {
+		runtime.fs = OSFS{}
+	}
+	return runtime
+}
+
+// Reset what's counted against the limits before running a program that
+// stops once ctx is done
+func (runtime *runtimeState) start(ctx context.Context) {
+	runtime.steps, runtime.allocated = 0, 0
+	runtime.deadline = time.Time{}
+	if runtime.timeout > 0 {
+		runtime.deadline = time.Now().Add(runtime.timeout)
+	}
+	runtime.ctx, runtime.done = ctx, ctx.Done()
+}
+
+func (runtime *runtimeState) acquire(r resource) {
+	if runtime.resources == nil {
+		runtime.resources = make(map[resource]bool)
+	}
+	runtime.resources[r] = true
+}
+
+func (runtime *runtimeState) release(r resource) {
+	delete(runtime.resources, r)
+}
+
+// Close whatever programs left open, which releases them on their own
+func (runtime *runtimeState) closeResources() {
+	for r := range runtime.resources {
+		r.close()
+	}
+}
+
+// Count a statement or a loop iteration. The clock and the context are only
+// checked every so often as they're slower than the rest of a step
+func (runtime *runtimeState) step() interruption {
+	runtime.steps++
+	if runtime.maxSteps > 0 && runtime.steps > runtime.maxSteps {
+		return &LimitError{Limit: "steps", trace: fmt.Sprintf("step limit exceeded, max steps: %v", runtime.maxSteps)}
+	}
+	if runtime.steps%1024 != 0 {
+		return nil
+	}
+	if !runtime.deadline.IsZero() && time.Now().After(runtime.deadline) {
+		return &LimitError{Limit: "timeout", trace: "timeout exceeded"}
+	}
+	return runtime.cancelled()
+}
+
+// Write a line of output to a stream, or to the log sink one line at a time
+func (runtime *runtimeState) print(position string, stream string, text string) error {
+	if runtime.logSink != nil {
+		now := time.Now()
+		for _, line := range strings.Split(text, "\n") {
+			runtime.logSink(LogEntry{Time: now, Position: position, Stream: stream, Line: line})
+		}
+		return nil
+	}
+	writer := runtime.stdout
+	if stream == "stderr" {
+		writer = runtime.stderr
+	}
+	_, err := io.WriteString(writer, text+"\n")
+	return err
+}
+
+// Check whether the program's context has been cancelled, this is done
+// on every function call and by builtins that wait on I/O
+func (runtime *runtimeState) cancelled() interruption {
+	if runtime.done == nil {
+		return nil
+	}
+	select {
+	case <-runtime.done:
+		err := runtime.ctx.Err()
+		return &CancelledError{err: err, trace: fmt.Sprintf("program stopped: %v", err)}
+	default:
+		return nil
+	}
+}
+
+// Count the approximate size of a new list, dict, or string
+func (runtime *runtimeState) allocate(size int) *LimitError {
+	return runtime.allocateItems(int64(size), 1, 1)
+}
+
+// Count count * repeats items of a size. Sizes that would overflow are
+// clamped, so huge requests fail the limit rather than wrapping around
+func (runtime *runtimeState) allocateItems(count int64, repeats int64, itemSize int64) *LimitError {
+	size := int64(math.MaxInt64)
+	if count == 0 || repeats == 0 {
+		size = 0
+	} else if count <= math.MaxInt64/repeats && count*repeats <= math.MaxInt64/itemSize {
+		size = count * repeats * itemSize
+	}
+	if size > math.MaxInt64-runtime.allocated {
+		runtime.allocated = math.MaxInt64
+	} else {
+		runtime.allocated += size
+	}
+	if runtime.maxMemory > 0 && runtime.allocated > runtime.maxMemory {
+		return &LimitError{Limit: "memory", trace: fmt.Sprintf("memory limit exceeded, max memory: %v bytes", runtime.maxMemory)}
+	}
+	return nil
+}
+
+// Add the stack trace of where the program was stopped to the message
+func (limitError *LimitError) at(frame *StackFrame, position string) error {
+	return LimitError{Limit: limitError.Limit, trace: traceError(frame, position, limitError.trace).Error()}
+}
+
+func (cancelledError *CancelledError) at(frame *StackFrame, position string) error {
+	return CancelledError{err: cancelledError.err, trace: traceError(frame, position, cancelledError.trace).Error()}
+}
+
+func RunProgram(filename string, source string) (string, *Context, error) {
+	return RunProgramWithOptions(filename, source, Options{})
+}
+
+func RunProgramWithOptions(filename string, source string, options Options) (string, *Context, error) {
+	return RunProgramContext(context.Background(), filename, source, options)
+}
+
+// Like RunProgramWithOptions, but the program stops with a CancelledError
+// once ctx is done. It's checked on loop iterations, function calls, and
+// builtins that do I/O. Files and generators that the program left open
+// are closed when it ends
+func RunProgramContext(ctx context.Context, filename string, source string, options Options) (string, *Context, error) {
+	runtime := newRuntimeState(options)
+	runtime.start(ctx)
+	defer runtime.closeResources()
+	// The program is a module too, if it's imported that's a cycle
+	runtime.enterModule(runtime.canonicalPath(filename), filename, &module{loading: true})
+	return runProgram(filename, source, runtime)
+}
+
+// Imported modules share the importer's runtime e.g. its registered methods
+func runProgram(filename string, source string, runtime *runtimeState) (string, *Context, error) {
 	context := Context{}
 	context.Init(filename)
+	context.stackFrame.runtime = runtime
 	InjectRuntime(&context)
 
-	result, err := program.Eval(&context.stackFrame)
+	result, err := execSource(&context.stackFrame, filename, source)
 	if err != nil {
 		return "", nil, err
 	}
-
 	return result.String(), &context, nil
 }
+
+// Run a program in a top-level frame, which can already have variables
+func execSource(frame *StackFrame, filename string, source string) (Value, error) {
+	program, err := GenerateAST(source)
+	if err != nil {
+		return nil, fmt.Errorf("\n%v:%v", filename, err.Error())
+	}
+	if err := checkTypes(filename, program); err != nil {
+		return nil, err
+	}
+	runtime := frame.runtime
+	if !runtime.noOptimise {
+		optimise(program)
+	}
+
+	if runtime.treeWalker {
+		return program.Eval(frame)
+	}
+	return execProgram(frame, compileProgram(filename, program, frame.scope))
+}
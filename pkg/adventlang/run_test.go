@@ -0,0 +1,135 @@
+package adventlang
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a program on both engines and check that it stops at a limit
+func expectLimit(t *testing.T, source string, options Options, limit string) {
+	t.Helper()
+	for _, treeWalker := range []bool{false, true} {
+		options.TreeWalker = treeWalker
+		_, _, err := RunProgramWithOptions("test.adv", source, options)
+		limitError, okLimit := err.(LimitError)
+		if !okLimit || limitError.Limit != limit {
+			t.Fatalf("%q (tree-walker: %v) failed with %v, wanted a %v LimitError", source, treeWalker, err, limit)
+		}
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	expectLimit(t, `while (true) {}`, Options{MaxSteps: 1000}, "steps")
+	expectLimit(t, `let f = func() { return f(); }; f();`, Options{MaxSteps: 1000}, "steps")
+	expectLimit(t, `for (x in [1, 2, 3]) {}`, Options{MaxSteps: 2}, "steps")
+}
+
+func TestTimeoutLimit(t *testing.T) {
+	start := time.Now()
+	expectLimit(t, `while (true) {}`, Options{Timeout: 50 * time.Millisecond}, "timeout")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("took %v to time out", elapsed)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	expectLimit(t, `let l = []; while (true) { l.append(1); }`, Options{MaxMemory: 1 << 20}, "memory")
+	expectLimit(t, `let s = "a"; while (true) { s = s + s; }`, Options{MaxMemory: 1 << 20}, "memory")
+	expectLimit(t, `let d = {}; let i = 0; while (true) { d[str(i)] = i; i = i + 1; }`, Options{MaxMemory: 1 << 20}, "memory")
+}
+
+func TestLimitErrorPosition(t *testing.T) {
+	_, _, err := RunProgramWithOptions("test.adv", "let i = 0;\nwhile (true) { i = i + 1; }", Options{MaxSteps: 100})
+	if err == nil || !strings.Contains(err.Error(), "test.adv:2:1: step limit exceeded, max steps: 100") {
+		t.Fatalf("got %v, wanted the position of the loop", err)
+	}
+}
+
+func TestWithinLimits(t *testing.T) {
+	options := Options{MaxSteps: 10000, Timeout: time.Minute, MaxMemory: 1 << 20}
+	result, _, err := RunProgramWithOptions("test.adv", `let sum = 0; for (x in [1, 2, 3]) { sum = sum + x; } sum;`, options)
+	if err != nil || result != "6" {
+		t.Fatalf("got %q, %v, wanted 6", result, err)
+	}
+}
+
+func TestRunProgramContextDeadline(t *testing.T) {
+	for _, treeWalker := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, err := RunProgramContext(ctx, "test.adv", `while (true) {}`, Options{TreeWalker: treeWalker})
+		cancel()
+		if _, okCancelled := err.(CancelledError); !okCancelled || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("(tree-walker: %v) failed with %v, wanted a CancelledError wrapping the deadline", treeWalker, err)
+		}
+	}
+}
+
+func TestRunProgramContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := RunProgramContext(ctx, "test.adv", `let f = func(n) { return n + 1; }; while (true) { f(1); }`, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("failed with %v, wanted context.Canceled", err)
+	}
+	if !strings.Contains(err.Error(), "program stopped: context canceled") {
+		t.Fatalf("failed with %q, wanted why it stopped", err.Error())
+	}
+}
+
+func TestRunProgramContextGenerator(t *testing.T) {
+	// Generators run on their own goroutines, and stop too
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := RunProgramContext(ctx, "test.adv", `let g = func() { while (true) { yield 1; } }; for (x in g()) {}`, Options{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("failed with %v, wanted context.DeadlineExceeded", err)
+	}
+}
+
+func TestOutputStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	_, _, err := RunProgramWithOptions("test.adv", `print("a", 1); print_err("b"); log([2]);`,
+		Options{Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "a, 1\n" || stderr.String() != "b\n[2]\n" {
+		t.Fatalf("got stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	var stdout bytes.Buffer
+	var entries []LogEntry
+	// Each line of a string is its own entry
+	before := time.Now()
+	_, _, err := RunProgramWithOptions("test.adv", "print(\"a\nb\");\nprint_err(1);",
+		Options{Stdout: &stdout, LogSink: func(entry LogEntry) { entries = append(entries, entry) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("wrote %q with a log sink", stdout.String())
+	}
+	want := []LogEntry{
+		{Position: "test.adv:1:6", Stream: "stdout", Line: "a"},
+		{Position: "test.adv:1:6", Stream: "stdout", Line: "b"},
+		{Position: "test.adv:3:10", Stream: "stderr", Line: "1"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %v, wanted %v", entries, want)
+	}
+	for i, entry := range entries {
+		if entry.Time.Before(before) {
+			t.Fatalf("entry %v is from before the program ran", entry)
+		}
+		entry.Time = time.Time{}
+		if entry != want[i] {
+			t.Fatalf("got %+v, wanted %+v", entry, want[i])
+		}
+	}
+}
@@ -3,7 +3,6 @@ package adventlang
 import (
 	"bufio"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -27,16 +26,23 @@ func InjectRuntime(context *Context) {
 	setNativeFunc("prepop", NativeFunctionValue{name: "prepop", Exec: doPrepop}, &context.stackFrame)
 	setNativeFunc("assert", NativeFunctionValue{name: "assert", Exec: doAssert}, &context.stackFrame)
 	setNativeFunc("log", NativeFunctionValue{name: "log", Exec: doLog}, &context.stackFrame)
+	setNativeFunc("print", NativeFunctionValue{name: "print", Exec: doPrint}, &context.stackFrame)
+	setNativeFunc("print_err", NativeFunctionValue{name: "print_err", Exec: doPrintErr}, &context.stackFrame)
 	setNativeFunc("time", NativeFunctionValue{name: "time", Exec: doTime}, &context.stackFrame)
 	setNativeFunc("type", NativeFunctionValue{name: "type", Exec: doType}, &context.stackFrame)
 	setNativeFunc("str", NativeFunctionValue{name: "str", Exec: doStr}, &context.stackFrame)
 	setNativeFunc("num", NativeFunctionValue{name: "num", Exec: doNum}, &context.stackFrame)
 	setNativeFunc("floor", NativeFunctionValue{name: "floor", Exec: doFloor}, &context.stackFrame)
 	setNativeFunc("read_lines", NativeFunctionValue{name: "read_lines", Exec: doReadLines}, &context.stackFrame)
+	setNativeFunc("list", NativeFunctionValue{name: "list", Exec: doList}, &context.stackFrame)
+	setNativeFunc("take", NativeFunctionValue{name: "take", Exec: doTake}, &context.stackFrame)
+	setNativeFunc("zip", NativeFunctionValue{name: "zip", Exec: doZip}, &context.stackFrame)
+	setNativeFunc("method", NativeFunctionValue{name: "method", Exec: doMethod}, &context.stackFrame)
+	setNativeFunc("freeze", NativeFunctionValue{name: "freeze", Exec: doFreeze}, &context.stackFrame)
 }
 
 func setNativeFunc(key string, nativeFunc Value, frame *StackFrame) {
-	frame.entries[key] = nativeFunc
+	frame.declare(key, nativeFunc)
 }
 
 type NativeFunctionValue struct {
@@ -64,16 +70,7 @@ func doImport(frame *StackFrame, position string, args []Value) (Value, error) {
 			fmt.Sprintf("import: incorrect number of arguments, wanted: 1, got: %v ", len(args)))
 	}
 	if strValue, okStr := args[0].(StringValue); okStr {
-		source := ReadProgram(strValue.String())
-		_, context, err := RunProgram(strValue.String(), source)
-		if err != nil {
-			return nil, err
-		}
-		dictValue := DictValue{val: map[string]*Value{}}
-		for id, value := range context.stackFrame.entries {
-			dictValue.Set(id, value)
-		}
-		return dictValue, nil
+		return frame.runtime.importModule(frame, position, strValue.String())
 	}
 	argType, err := doType(frame, position, []Value{args[0]})
 	if err != nil {
@@ -89,7 +86,7 @@ func doKeys(frame *StackFrame, position string, args []Value) (Value, error) {
 			fmt.Sprintf("keys: incorrect number of arguments, wanted: 1, got: %v ", len(args)))
 	}
 	if dictValue, okDict := args[0].(DictValue); okDict {
-		listValue := ListValue{val: make(map[int]*Value)}
+		listValue := newListValue(0)
 		for key := range dictValue.val {
 			listValue.Append(StringValue{val: []byte(key)})
 		}
@@ -109,13 +106,13 @@ func doValues(frame *StackFrame, position string, args []Value) (Value, error) {
 			fmt.Sprintf("values: incorrect number of arguments, wanted: 1, got: %v ", len(args)))
 	}
 	if dictValue, okDict := args[0].(DictValue); okDict {
-		listValue := ListValue{val: make(map[int]*Value)}
+		listValue := newListValue(0)
 		for key := range dictValue.val {
 			value, err := dictValue.Get(key)
 			if err != nil {
 				panic(err)
 			}
-			listValue.Append(*value)
+			listValue.Append(itemOf(dictValue.isFrozen(), *value))
 		}
 		return listValue, nil
 	}
@@ -132,6 +129,9 @@ func doDelete(frame *StackFrame, position string, args []Value) (Value, error) {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("delete: incorrect number of arguments, wanted: 2, got: %v ", len(args)))
 	}
+	if err := checkFrozen(frame, position, "delete", args[0]); err != nil {
+		return nil, err
+	}
 
 	if dictValue, okDict := args[0].(DictValue); okDict {
 		if strValue, okStr := args[1].(StringValue); okStr {
@@ -173,12 +173,15 @@ func doLen(frame *StackFrame, position string, args []Value) (Value, error) {
 	if listValue, listOk := args[0].(ListValue); listOk {
 		return NumberValue{val: float64(len(listValue.val))}, nil
 	}
+	if dictValue, dictOk := args[0].(DictValue); dictOk {
+		return NumberValue{val: float64(len(dictValue.val))}, nil
+	}
 	argType, err := doType(frame, position, []Value{args[0]})
 	if err != nil {
 		return nil, err
 	}
 	return nil, traceError(frame, position,
-		"len: the single argument should be a variable, string, or list, got: "+argType.String())
+		"len: the single argument should be a variable, string, list, or dict, got: "+argType.String())
 }
 
 func doAppend(frame *StackFrame, position string, args []Value) (Value, error) {
@@ -186,9 +189,15 @@ func doAppend(frame *StackFrame, position string, args []Value) (Value, error) {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("append: incorrect number of arguments, wanted: 2, got: %v ", len(args)))
 	}
+	if err := checkFrozen(frame, position, "append", args[0]); err != nil {
+		return nil, err
+	}
 	if listValue, listOk := args[0].(ListValue); listOk {
 		// 2nd argument can be any type
 		// anything the user has access to should fit in a list
+		if limit := frame.runtime.allocate(listItemSize); limit != nil {
+			return nil, limit.at(frame, position)
+		}
 		listValue.Append(args[1])
 		return UndefinedValue{}, nil
 	}
@@ -205,9 +214,15 @@ func doPrepend(frame *StackFrame, position string, args []Value) (Value, error)
 		return nil, traceError(frame, position,
 			fmt.Sprintf("prepend: incorrect number of arguments, wanted: 2, got: %v ", len(args)))
 	}
+	if err := checkFrozen(frame, position, "prepend", args[0]); err != nil {
+		return nil, err
+	}
 	if listValue, listOk := args[0].(ListValue); listOk {
 		// 2nd argument can be any type
 		// anything the user has access to should fit in a list
+		if limit := frame.runtime.allocate(listItemSize); limit != nil {
+			return nil, limit.at(frame, position)
+		}
 		listValue.Prepend(args[1])
 		return UndefinedValue{}, nil
 	}
@@ -224,6 +239,9 @@ func doPop(frame *StackFrame, position string, args []Value) (Value, error) {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("pop: incorrect number of arguments, wanted: 1, got: %v ", len(args)))
 	}
+	if err := checkFrozen(frame, position, "pop", args[0]); err != nil {
+		return nil, err
+	}
 	if listValue, listOk := args[0].(ListValue); listOk {
 		if len(listValue.val) == 0 {
 			return nil, traceError(frame, position, "pop: called on an empty list")
@@ -243,6 +261,9 @@ func doPopat(frame *StackFrame, position string, args []Value) (Value, error) {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("popat: incorrect number of arguments, wanted: 2, got: %v ", len(args)))
 	}
+	if err := checkFrozen(frame, position, "popat", args[0]); err != nil {
+		return nil, err
+	}
 	if listValue, listOk := args[0].(ListValue); listOk {
 		if len(listValue.val) == 0 {
 			return nil, traceError(frame, position, "popat: called on an empty list")
@@ -271,6 +292,9 @@ func doPrepop(frame *StackFrame, position string, args []Value) (Value, error) {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("prepop: incorrect number of arguments, wanted: 1, got: %v ", len(args)))
 	}
+	if err := checkFrozen(frame, position, "prepop", args[0]); err != nil {
+		return nil, err
+	}
 	if listValue, listOk := args[0].(ListValue); listOk {
 		if len(listValue.val) == 0 {
 			return nil, traceError(frame, position, "prepop: called on an empty list")
@@ -301,16 +325,35 @@ func doAssert(frame *StackFrame, position string, args []Value) (Value, error) {
 	return UndefinedValue{}, nil
 }
 
+// `log` is for debugging and writes to stderr, like `print_err`. `print`
+// writes a program's output to stdout
 func doLog(frame *StackFrame, position string, args []Value) (Value, error) {
+	return printValues(frame, position, "log", "stderr", args)
+}
+
+func doPrint(frame *StackFrame, position string, args []Value) (Value, error) {
+	return printValues(frame, position, "print", "stdout", args)
+}
+
+func doPrintErr(frame *StackFrame, position string, args []Value) (Value, error) {
+	return printValues(frame, position, "print_err", "stderr", args)
+}
+
+func printValues(frame *StackFrame, position string, name string, stream string, args []Value) (Value, error) {
 	if len(args) == 0 {
 		return nil, traceError(frame, position,
-			fmt.Sprintf("log: incorrect number of arguments, wanted: at least 1, got: %v", len(args)))
+			fmt.Sprintf("%v: incorrect number of arguments, wanted: at least 1, got: %v", name, len(args)))
+	}
+	if stop := frame.runtime.cancelled(); stop != nil {
+		return nil, stop.at(frame, position)
 	}
 	s := make([]string, len(args))
 	for i := range args {
 		s[i] = args[i].String()
 	}
-	println(strings.Join(s, ", "))
+	if err := frame.runtime.print(frame.filename+":"+position, stream, strings.Join(s, ", ")); err != nil {
+		return nil, traceError(frame, position, fmt.Sprintf("%v: %v", name, err))
+	}
 	return UndefinedValue{}, nil
 }
 
@@ -327,26 +370,35 @@ func doType(frame *StackFrame, position string, args []Value) (Value, error) {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("type: incorrect number of arguments, wanted: 1, got: %v", len(args)))
 	}
-	value := args[0]
-	switch value.(type) {
+	return StringValue{val: []byte(typeName(args[0]))}, nil
+}
+
+// The name of a value's type as reported by `type()`
+func typeName(value Value) string {
+	switch typedValue := value.(type) {
 	case IdentifierValue:
-		return StringValue{val: []byte("identifier")}, nil
+		return "identifier"
 	case StringValue:
-		return StringValue{val: []byte("string")}, nil
+		return "string"
 	case NumberValue:
-		return StringValue{val: []byte("number")}, nil
+		return "number"
 	case BoolValue:
-		return StringValue{val: []byte("bool")}, nil
+		return "bool"
 	case FunctionValue, NativeFunctionValue:
-		return StringValue{val: []byte("function")}, nil
+		return "function"
 	case ListValue:
-		return StringValue{val: []byte("list")}, nil
+		return "list"
 	case DictValue:
-		return StringValue{val: []byte("dict")}, nil
+		if typedValue.class != nil {
+			return typedValue.class.name
+		}
+		return "dict"
+	case ClassValue:
+		return "class"
 	case UndefinedValue:
-		return StringValue{val: []byte("undefined")}, nil
+		return "undefined"
 	case ReferenceValue:
-		return StringValue{val: []byte("reference")}, nil
+		return "reference"
 	}
 	panic("unreachable")
 }
@@ -369,13 +421,26 @@ func doStr(frame *StackFrame, position string, args []Value) (Value, error) {
 		}
 		return StringValue{val: []byte("false")}, nil
 	}
+	if isFunction(value) {
+		return StringValue{val: []byte(strings.TrimSpace(value.String()))}, nil
+	}
+	if method, okMethod := getMethod(value, "to_string"); okMethod {
+		result, err := callFunction(frame, position, method, []Value{})
+		if err != nil {
+			return nil, err
+		}
+		if _, okStr := result.(StringValue); !okStr {
+			return nil, traceError(frame, position, "to_string should return a string, got: "+typeName(result))
+		}
+		return result, nil
+	}
 
 	valueType, err := doType(frame, position, args)
 	if err != nil {
 		return nil, err
 	}
 	return nil, traceError(frame, position,
-		fmt.Sprintf("str: expects a single argument of type string, number, or bool, got: %v", valueType))
+		fmt.Sprintf("str: expects a single argument of type string, number, bool, or function, got: %v", valueType))
 }
 
 func doFloor(frame *StackFrame, position string, args []Value) (Value, error) {
@@ -417,46 +482,57 @@ func doNum(frame *StackFrame, position string, args []Value) (Value, error) {
 		fmt.Sprintf("num: expects a single argument of type string, got: %v", valueType))
 }
 
+// With a callback, calls it with each line. Otherwise returns an iterator of
+// lines, see newLineIterator. Like imports, paths starting with ./ or ../ are
+// relative to the file that's running
 func doReadLines(frame *StackFrame, position string, args []Value) (Value, error) {
-	if len(args) != 2 {
+	if len(args) != 1 && len(args) != 2 {
 		return nil, traceError(frame, position,
-			fmt.Sprintf("read_lines: incorrect number of arguments, wanted: 2, got: %v", len(args)))
+			fmt.Sprintf("read_lines: incorrect number of arguments, wanted: 1 or 2, got: %v", len(args)))
 	}
 	var path string
 	var callback FunctionValue
 	if stringValue, stringOk := args[0].(StringValue); stringOk {
 		path = stringValue.String()
 	} else {
-		valueType, err := doType(frame, position, args)
-		if err != nil {
-			return nil, err
-		}
 		return nil, traceError(frame, position,
-			fmt.Sprintf("read_lines: expects the 1st argument to be a filepath, got: %v", valueType))
+			fmt.Sprintf("read_lines: expects the 1st argument to be a filepath, got: %v", typeName(args[0])))
 	}
-	if functionValue, functionOk := args[1].(FunctionValue); functionOk {
-		callback = functionValue
-	} else {
-		valueType, err := doType(frame, position, args)
-		if err != nil {
-			return nil, err
+	if len(args) == 2 {
+		if functionValue, functionOk := args[1].(FunctionValue); functionOk {
+			callback = functionValue
+		} else {
+			return nil, traceError(frame, position,
+				fmt.Sprintf("read_lines: expects the 2nd argument to be a function, got: %v", typeName(args[1])))
 		}
-		return nil, traceError(frame, position,
-			fmt.Sprintf("read_lines: expects the 2nd argument to be a function, got: %v", valueType))
 	}
 
-	f, err := os.Open(path)
+	if isRelativeImport(path) {
+		path = resolveImport(frame.filename, path)
+	}
+	f, err := frame.runtime.fs.Open(path)
 	if err != nil {
 		return nil, traceError(frame, position,
 			fmt.Sprintf("read_lines: while reading %v: %v", path, err))
 	}
-	defer f.Close()
+
+	if len(args) == 1 {
+		return newLineIterator(frame, position, path, f), nil
+	}
 
 	scanner := bufio.NewScanner(f)
+	defer f.Close()
 	for scanner.Scan() {
+		if stop := frame.runtime.cancelled(); stop != nil {
+			return nil, stop.at(frame, position)
+		}
 		arg := StringValue{val: []byte(scanner.Text())}
 		_, err = callback.Exec(callback.position, []Value{arg})
 		if err != nil {
+			// Stopping the program isn't a problem with the file
+			if isInterruption(err) {
+				return nil, err
+			}
 			return nil, traceError(frame, position,
 				fmt.Sprintf("read_lines: while reading %v: %v", path, err))
 		}
@@ -469,3 +545,139 @@ func doReadLines(frame *StackFrame, position string, args []Value) (Value, error
 	}
 	return UndefinedValue{}, nil
 }
+
+// Collect the items of any iterable into a list
+func doList(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 1 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("list: incorrect number of arguments, wanted: 1, got: %v", len(args)))
+	}
+	listValue := newListValue(0)
+	err := iterate(frame, position, args[0], func(key Value, value Value) error {
+		if limit := frame.runtime.allocate(listItemSize); limit != nil {
+			return limit.at(frame, position)
+		}
+		listValue.Append(iterationItem(args[0], key, value))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return listValue, nil
+}
+
+// Collect at most n items, which also works for endless iterators
+func doTake(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 2 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("take: incorrect number of arguments, wanted: 2, got: %v", len(args)))
+	}
+	count, okInt := toInteger(args[1])
+	if !okInt || count < 0 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("take: the 2nd argument should be a whole number, got: %v", args[1]))
+	}
+	next, err := getIterator(frame, position, args[0])
+	if err != nil {
+		return nil, err
+	}
+	listValue := newListValue(0)
+	for i := int64(0); i < count; i++ {
+		key, value, done, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+		if limit := frame.runtime.allocate(listItemSize); limit != nil {
+			return nil, limit.at(frame, position)
+		}
+		listValue.Append(iterationItem(args[0], key, value))
+	}
+	return listValue, nil
+}
+
+// Pair up the items of iterables until the shortest is exhausted
+// e.g. `zip([1, 2], "ab")` is `[[1, "a"], [2, "b"]]`
+func doZip(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) == 0 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("zip: incorrect number of arguments, wanted: at least 1, got: %v", len(args)))
+	}
+	iterators := make([]iterator, len(args))
+	for i, arg := range args {
+		next, err := getIterator(frame, position, arg)
+		if err != nil {
+			return nil, err
+		}
+		iterators[i] = next
+	}
+	listValue := newListValue(0)
+	for {
+		items := newListValue(0)
+		for i, next := range iterators {
+			key, value, done, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return listValue, nil
+			}
+			items.Append(iterationItem(args[i], key, value))
+		}
+		if limit := frame.runtime.allocate((len(items.val) + 1) * listItemSize); limit != nil {
+			return nil, limit.at(frame, position)
+		}
+		listValue.Append(items)
+	}
+}
+
+// Freezing changes the value itself, and everything in it, so it can't be
+// changed through any variable. It's returned for convenience
+func doFreeze(frame *StackFrame, position string, args []Value) (Value, error) {
+	if len(args) != 1 {
+		return nil, traceError(frame, position,
+			fmt.Sprintf("freeze: incorrect number of arguments, wanted: 1, got: %v", len(args)))
+	}
+	freezeValue(args[0])
+	return args[0], nil
+}
+
+// Values that are already frozen are skipped, which also stops at lists
+// and dicts that contain themselves
+func freezeValue(value Value) {
+	switch typedValue := value.(type) {
+	case ListValue:
+		if typedValue.isFrozen() {
+			return
+		}
+		*typedValue.frozen = true
+		for _, item := range typedValue.val {
+			freezeValue(*item)
+		}
+	case DictValue:
+		if typedValue.isFrozen() {
+			return
+		}
+		*typedValue.frozen = true
+		for _, item := range typedValue.val {
+			freezeValue(*item)
+		}
+	}
+}
+
+// Lists and dicts made with `freeze()` can't be changed
+func checkFrozen(frame *StackFrame, position string, name string, value Value) error {
+	switch typedValue := value.(type) {
+	case ListValue:
+		if typedValue.isFrozen() {
+			return traceError(frame, position, name+": can't change a frozen list")
+		}
+	case DictValue:
+		if typedValue.isFrozen() {
+			return traceError(frame, position, name+": can't change a frozen dict")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,729 @@
+package adventlang
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Type annotations are optional. Before a program runs, a checker infers what
+// it can and reports annotated values that can't match. An unknown (nil) type
+// matches anything. At runtime, annotated parameters are checked when they're
+// bound, but only their outer type e.g. `list` for `list<number>` so that calls
+// stay cheap
+
+var builtinTypeNames = map[string]bool{
+	"any":       true,
+	"number":    true,
+	"string":    true,
+	"bool":      true,
+	"list":      true,
+	"dict":      true,
+	"function":  true,
+	"class":     true,
+	"undefined": true,
+}
+
+// Builtins that always return the same type
+var builtinReturnTypes = map[string]string{
+	"len":   "number",
+	"str":   "string",
+	"type":  "string",
+	"num":   "number",
+	"floor": "number",
+	"keys":  "list",
+	"list":  "list",
+	"zip":   "list",
+	"take":  "list",
+}
+
+func simpleType(name string) *TypeExpr {
+	return &TypeExpr{Name: name}
+}
+
+func paramTypes(params []*Param) []*TypeExpr {
+	var types []*TypeExpr
+	for i, param := range params {
+		if param.Type != nil {
+			if types == nil {
+				types = make([]*TypeExpr, len(params))
+			}
+			types[i] = param.Type
+		}
+	}
+	return types
+}
+
+// Whether a runtime value has an annotated type
+func matchesType(value Value, typeExpr *TypeExpr) bool {
+	if typeExpr == nil {
+		return true
+	}
+	for alternative := typeExpr; alternative != nil; alternative = alternative.Or {
+		if alternative.Name == "any" || alternative.Name == typeName(value) {
+			return true
+		}
+		if dictValue, okDict := value.(DictValue); okDict && alternative.Name == "dict" && dictValue.class != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a value of type `got` can be used where `want` is expected. Only one
+// alternative of `got` needs to match as the checker can't narrow types
+func compatible(want *TypeExpr, got *TypeExpr) bool {
+	if want == nil || got == nil {
+		return true
+	}
+	for gotAlternative := got; gotAlternative != nil; gotAlternative = gotAlternative.Or {
+		for wantAlternative := want; wantAlternative != nil; wantAlternative = wantAlternative.Or {
+			if wantAlternative.Name == "any" || gotAlternative.Name == "any" {
+				return true
+			}
+			if wantAlternative.Name == gotAlternative.Name && compatibleParams(wantAlternative.Params, gotAlternative.Params) {
+				return true
+			}
+			// Class instances are dicts
+			if wantAlternative.Name == "dict" && !builtinTypeNames[gotAlternative.Name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compatibleParams(want []*TypeExpr, got []*TypeExpr) bool {
+	if len(want) == 0 || len(got) == 0 {
+		return true
+	}
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if !compatible(want[i], got[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+type typeChecker struct {
+	filename string
+	errors   []string
+}
+
+type typeScope struct {
+	bindings map[string]*typeBinding
+	parent   *typeScope
+	// The enclosing function, for checking returns
+	function *funcSignature
+}
+
+// What's known about a variable
+type typeBinding struct {
+	// The annotated type, if any
+	declared *TypeExpr
+	// Set while the variable is known to hold a function
+	signature *funcSignature
+	// Set for classes, calling one creates an instance of this type
+	class string
+}
+
+type funcSignature struct {
+	name   string
+	params []*Param
+	// The annotated return type, nil when unknown
+	returns   *TypeExpr
+	generator bool
+	// Builtins aren't checked by arity
+	builtin bool
+}
+
+// Unannotated functions are left to the runtime
+func (signature *funcSignature) annotated() bool {
+	if signature.returns != nil {
+		return true
+	}
+	for _, param := range signature.params {
+		if param.Type != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a program's annotations before it runs
+func checkTypes(filename string, program *Program) error {
+	checker := typeChecker{filename: filename}
+	root := &typeScope{bindings: make(map[string]*typeBinding)}
+	for name, returns := range builtinReturnTypes {
+		root.bindings[name] = &typeBinding{signature: &funcSignature{
+			name: name, returns: simpleType(returns), builtin: true}}
+	}
+	checker.block(program.Statements, root.child())
+	if len(checker.errors) > 0 {
+		return errors.New(strings.Join(checker.errors, ""))
+	}
+	return nil
+}
+
+func (checker *typeChecker) errorf(position string, format string, args ...interface{}) {
+	checker.errors = append(checker.errors, "\n"+checker.filename+":"+position+": "+fmt.Sprintf(format, args...))
+}
+
+func (scope *typeScope) child() *typeScope {
+	return &typeScope{bindings: make(map[string]*typeBinding), parent: scope, function: scope.function}
+}
+
+func (scope *typeScope) lookup(name string) *typeBinding {
+	for ; scope != nil; scope = scope.parent {
+		if binding, ok := scope.bindings[name]; ok {
+			return binding
+		}
+	}
+	return nil
+}
+
+// Annotations can only give element types to lists and dicts
+func (checker *typeChecker) annotation(typeExpr *TypeExpr) {
+	for alternative := typeExpr; alternative != nil; alternative = alternative.Or {
+		if len(alternative.Params) > 1 || len(alternative.Params) == 1 && alternative.Name != "list" && alternative.Name != "dict" {
+			checker.errorf(alternative.Pos.String(), "only list and dict take an element type, got: %v", alternative)
+		}
+		for _, param := range alternative.Params {
+			checker.annotation(param)
+		}
+	}
+}
+
+func (checker *typeChecker) block(statements []*Statement, scope *typeScope) {
+	// Named functions are hoisted
+	for _, statement := range statements {
+		if funcStatement := statement.Func; funcStatement != nil {
+			scope.bindings[funcStatement.Name] = &typeBinding{signature: &funcSignature{
+				name:      funcStatement.Name,
+				params:    funcStatement.Params,
+				returns:   funcStatement.Return,
+				generator: containsYield(funcStatement.Block),
+			}}
+		}
+	}
+	for _, statement := range statements {
+		checker.statement(statement, scope)
+	}
+}
+
+func (checker *typeChecker) statement(statement *Statement, scope *typeScope) {
+	if statement.If != nil {
+		checker.expr(statement.If.Condition, scope)
+		checker.block(statement.If.If, scope.child())
+		checker.block(statement.If.Else, scope.child())
+	} else if statement.For != nil {
+		forScope := scope.child()
+		if forIn := statement.For.ForIn; forIn != nil {
+			checker.forIn(forIn, forScope)
+		}
+		checker.expr(statement.For.Init, forScope)
+		checker.expr(statement.For.Condition, forScope)
+		checker.expr(statement.For.Post, forScope)
+		checker.block(statement.For.Block, forScope)
+	} else if statement.While != nil {
+		whileScope := scope.child()
+		checker.expr(statement.While.Condition, whileScope)
+		checker.block(statement.While.Block, whileScope)
+	} else if statement.Class != nil {
+		memberScope := scope.child()
+		for _, member := range statement.Class.Members {
+			checker.expr(member.Value, memberScope)
+		}
+		scope.bindings[statement.Class.Name] = &typeBinding{class: statement.Class.Name}
+	} else if statement.Func != nil {
+		checker.function(scope.lookup(statement.Func.Name).signature, statement.Func.Block, scope)
+	} else if statement.Return != nil {
+		returnType := simpleType("undefined")
+		if statement.Return.Expr != nil {
+			returnType = checker.expr(statement.Return.Expr, scope)
+		}
+		function := scope.function
+		if function != nil && !function.generator && !compatible(function.returns, returnType) {
+			checker.errorf(statement.Pos.String(), "%v should return %v, got: %v", function.describe(), function.returns, returnType)
+		}
+	} else if statement.Yield != nil {
+		checker.expr(statement.Yield.Expr, scope)
+	} else if statement.Expr != nil {
+		checker.expr(statement.Expr, scope)
+	}
+}
+
+func (signature *funcSignature) describe() string {
+	if signature.name != "" {
+		return signature.name
+	}
+	return "function"
+}
+
+func (checker *typeChecker) function(signature *funcSignature, block []*Statement, scope *typeScope) {
+	bodyScope := scope.child()
+	bodyScope.function = signature
+	for _, param := range signature.params {
+		checker.annotation(param.Type)
+		bodyScope.bindings[param.Name] = &typeBinding{declared: param.Type}
+	}
+	checker.annotation(signature.returns)
+	checker.block(block, bodyScope)
+}
+
+func (checker *typeChecker) forIn(forIn *ForIn, scope *typeScope) {
+	checker.expr(forIn.Iterable, scope)
+	scope.bindings[*forIn.Key] = &typeBinding{}
+	if forIn.Value != nil {
+		scope.bindings[*forIn.Value] = &typeBinding{}
+	}
+}
+
+// Check an expression and return its type, if it's known
+func (checker *typeChecker) expr(expr *Expr, scope *typeScope) *TypeExpr {
+	if expr == nil {
+		return nil
+	}
+	return checker.assignment(expr.Assignment, scope)
+}
+
+func (checker *typeChecker) assignment(assignment *Assignment, scope *typeScope) *TypeExpr {
+	target := assignment.target()
+	var valueType *TypeExpr
+	var signature *funcSignature
+	if assignment.Next != nil {
+		valueType = checker.assignment(assignment.Next, scope)
+		if primary := assignment.Next.primary(); primary != nil && primary.FuncLiteral != nil && primary.CallChain == nil {
+			signature = checker.funcLiteralSignature(primary.FuncLiteral)
+		}
+	}
+	targetPrimary := target.primary()
+	var name string
+	if targetPrimary != nil && targetPrimary.Ident != nil && targetPrimary.CallChain == nil {
+		name = *targetPrimary.Ident
+	}
+
+	if assignment.Let != nil {
+		if assignment.Type != nil {
+			checker.annotation(assignment.Type)
+			if name == "" {
+				checker.errorf(assignment.Type.Pos.String(), "only variables can be annotated")
+			} else if assignment.Next != nil && !compatible(assignment.Type, valueType) {
+				checker.errorf(assignment.Pos.String(), "can't assign %v to %v of type %v", valueType, name, assignment.Type)
+			}
+		}
+		if name != "" {
+			if signature != nil {
+				signature.name = name
+			}
+			scope.bindings[name] = &typeBinding{declared: assignment.Type, signature: signature}
+		}
+		if assignment.Type != nil {
+			return assignment.Type
+		}
+		return valueType
+	}
+
+	if assignment.Op == nil {
+		return checker.ternary(target, scope)
+	}
+	if name != "" {
+		if binding := scope.lookup(name); binding != nil {
+			if !compatible(binding.declared, valueType) {
+				checker.errorf(assignment.Pos.String(), "can't assign %v to %v of type %v", valueType, name, binding.declared)
+			}
+			binding.signature = signature
+		}
+	} else {
+		checker.ternary(target, scope)
+	}
+	return valueType
+}
+
+func (checker *typeChecker) funcLiteralSignature(funcLiteral *FuncLiteral) *funcSignature {
+	return &funcSignature{
+		params:    funcLiteral.Params,
+		returns:   funcLiteral.Return,
+		generator: containsYield(funcLiteral.Block),
+	}
+}
+
+func (checker *typeChecker) ternary(ternary *Ternary, scope *typeScope) *TypeExpr {
+	condition := checker.nullish(ternary.Nullish, scope)
+	if ternary.Op == nil {
+		return condition
+	}
+	thenType := checker.ternary(ternary.Then, scope)
+	elseType := checker.ternary(ternary.Else, scope)
+	return sameType(thenType, elseType)
+}
+
+// Two branches have a known type when they agree
+func sameType(left *TypeExpr, right *TypeExpr) *TypeExpr {
+	if left != nil && right != nil && left.String() == right.String() {
+		return left
+	}
+	return nil
+}
+
+func (checker *typeChecker) nullish(nullish *Nullish, scope *typeScope) *TypeExpr {
+	left := checker.pipeline(nullish.Pipeline, scope)
+	if nullish.Op == nil {
+		return left
+	}
+	return sameType(left, checker.nullish(nullish.Next, scope))
+}
+
+func (checker *typeChecker) pipeline(pipeline *Pipeline, scope *typeScope) *TypeExpr {
+	left := checker.logicOr(pipeline.LogicOr, scope)
+	if len(pipeline.Stages) == 0 {
+		return left
+	}
+	// A stage's call gets the piped value as its first argument
+	for _, stage := range pipeline.Stages {
+		if stage.Call != nil && stage.Call.CallChain.Args != nil && stage.Call.CallChain.Next == nil {
+			left = checker.call(stage.Call, []*TypeExpr{left}, scope)
+		} else {
+			checker.primary(stage, scope)
+			left = nil
+		}
+	}
+	return left
+}
+
+func (checker *typeChecker) logicOr(logicOr *LogicOr, scope *typeScope) *TypeExpr {
+	left := checker.logicAnd(logicOr.LogicAnd, scope)
+	if logicOr.Op == nil {
+		return left
+	}
+	checker.logicOr(logicOr.Next, scope)
+	return simpleType("bool")
+}
+
+func (checker *typeChecker) logicAnd(logicAnd *LogicAnd, scope *typeScope) *TypeExpr {
+	left := checker.equality(logicAnd.Equality, scope)
+	if logicAnd.Op == nil {
+		return left
+	}
+	checker.logicAnd(logicAnd.Next, scope)
+	return simpleType("bool")
+}
+
+func (checker *typeChecker) equality(equality *Equality, scope *typeScope) *TypeExpr {
+	left := checker.comparison(equality.Comparison, scope)
+	if equality.Op == nil {
+		return left
+	}
+	checker.equality(equality.Next, scope)
+	return simpleType("bool")
+}
+
+func (checker *typeChecker) comparison(comparison *Comparison, scope *typeScope) *TypeExpr {
+	left := checker.bitwiseOr(comparison.BitwiseOr, scope)
+	if comparison.Op == nil {
+		return left
+	}
+	checker.comparison(comparison.Next, scope)
+	return simpleType("bool")
+}
+
+// Bitwise operators work on numbers, except `|` which also merges dicts
+func (checker *typeChecker) bitwiseOr(bitwiseOr *BitwiseOr, scope *typeScope) *TypeExpr {
+	left := checker.bitwiseXor(bitwiseOr.BitwiseXor, scope)
+	for _, op := range bitwiseOr.Ops {
+		right := checker.bitwiseXor(op.Next, scope)
+		if left != nil && right != nil && left.Name == "dict" && right.Name == "dict" {
+			left = simpleType("dict")
+		} else {
+			left = numberIfBoth(left, right)
+		}
+	}
+	return left
+}
+
+func (checker *typeChecker) bitwiseXor(bitwiseXor *BitwiseXor, scope *typeScope) *TypeExpr {
+	left := checker.bitwiseAnd(bitwiseXor.BitwiseAnd, scope)
+	for _, op := range bitwiseXor.Ops {
+		checker.bitwiseAnd(op.Next, scope)
+		left = simpleType("number")
+	}
+	return left
+}
+
+func (checker *typeChecker) bitwiseAnd(bitwiseAnd *BitwiseAnd, scope *typeScope) *TypeExpr {
+	left := checker.shift(bitwiseAnd.Shift, scope)
+	for _, op := range bitwiseAnd.Ops {
+		checker.shift(op.Next, scope)
+		left = simpleType("number")
+	}
+	return left
+}
+
+func (checker *typeChecker) shift(shift *Shift, scope *typeScope) *TypeExpr {
+	left := checker.addition(shift.Addition, scope)
+	for _, op := range shift.Ops {
+		checker.addition(op.Next, scope)
+		left = simpleType("number")
+	}
+	return left
+}
+
+func numberIfBoth(left *TypeExpr, right *TypeExpr) *TypeExpr {
+	if left != nil && right != nil && left.Name == "number" && right.Name == "number" {
+		return left
+	}
+	return nil
+}
+
+// `+` adds numbers and concatenates strings and lists
+func (checker *typeChecker) addition(addition *Addition, scope *typeScope) *TypeExpr {
+	left := checker.multiplication(addition.Multiplication, scope)
+	for _, op := range addition.Ops {
+		left = additionType(op.Op, left, checker.multiplication(op.Next, scope))
+	}
+	return left
+}
+
+func additionType(op string, left *TypeExpr, right *TypeExpr) *TypeExpr {
+	if op == "-" {
+		return simpleType("number")
+	}
+	if left != nil && right != nil && left.Name == right.Name && left.Or == nil && right.Or == nil {
+		switch left.Name {
+		case "number", "string", "list":
+			return simpleType(left.Name)
+		}
+	}
+	return nil
+}
+
+// `*` also repeats strings and lists
+func (checker *typeChecker) multiplication(multiplication *Multiplication, scope *typeScope) *TypeExpr {
+	left := checker.unary(multiplication.Unary, scope)
+	for _, op := range multiplication.Ops {
+		right := checker.unary(op.Next, scope)
+		if op.Op == "*" {
+			left = numberIfBoth(left, right)
+		} else {
+			left = simpleType("number")
+		}
+	}
+	return left
+}
+
+func (checker *typeChecker) unary(unary *Unary, scope *typeScope) *TypeExpr {
+	if unary.Op == nil {
+		return checker.power(unary.Power, scope)
+	}
+	checker.unary(unary.Unary, scope)
+	if *unary.Op == "!" {
+		return simpleType("bool")
+	}
+	return simpleType("number")
+}
+
+func (checker *typeChecker) power(power *Power, scope *typeScope) *TypeExpr {
+	left := checker.primary(power.Primary, scope)
+	if power.Op == nil {
+		return left
+	}
+	checker.unary(power.Next, scope)
+	return simpleType("number")
+}
+
+func (checker *typeChecker) primary(primary *Primary, scope *typeScope) *TypeExpr {
+	if primary.Call != nil {
+		return checker.call(primary.Call, nil, scope)
+	}
+	var operand *TypeExpr
+	if primary.FuncLiteral != nil {
+		checker.function(checker.funcLiteralSignature(primary.FuncLiteral), primary.FuncLiteral.Block, scope)
+		operand = simpleType("function")
+	} else if primary.ListLiteral != nil {
+		operand = checker.listLiteral(primary.ListLiteral, scope)
+	} else if primary.DictLiteral != nil {
+		checker.dictLiteral(primary.DictLiteral, scope)
+		operand = simpleType("dict")
+	} else if primary.SubExpression != nil {
+		operand = checker.expr(primary.SubExpression.Expr, scope)
+		if primary.SubExpression.CallChain != nil {
+			checker.callChain(primary.SubExpression.CallChain, scope)
+			return nil
+		}
+	} else if primary.Number != nil {
+		operand = simpleType("number")
+	} else if primary.Str != nil {
+		operand = simpleType("string")
+	} else if primary.True != nil || primary.False != nil {
+		operand = simpleType("bool")
+	} else if primary.Undefined != nil {
+		operand = simpleType("undefined")
+	} else if primary.Ident != nil {
+		if binding := scope.lookup(*primary.Ident); binding != nil {
+			operand = binding.valueType()
+		}
+	}
+	if primary.CallChain != nil {
+		checker.callChain(primary.CallChain, scope)
+		return nil
+	}
+	return operand
+}
+
+func (binding *typeBinding) valueType() *TypeExpr {
+	if binding.declared != nil {
+		return binding.declared
+	}
+	if binding.class != "" {
+		return simpleType("class")
+	}
+	if binding.signature != nil {
+		return simpleType("function")
+	}
+	return nil
+}
+
+// Calls to known functions are checked against their parameters.
+// `piped` are the types of any arguments given by a pipeline
+func (checker *typeChecker) call(call *Call, piped []*TypeExpr, scope *typeScope) *TypeExpr {
+	binding := scope.lookup(*call.Ident)
+	chain := call.CallChain
+	if binding == nil || chain.Args == nil {
+		checker.callChain(chain, scope)
+		return nil
+	}
+	argTypes := piped
+	for _, arg := range chain.Args.Exprs {
+		argTypes = append(argTypes, checker.expr(arg, scope))
+	}
+	if chain.Next != nil {
+		checker.callChain(chain.Next, scope)
+	}
+
+	var result *TypeExpr
+	if signature := binding.signature; signature != nil {
+		if !signature.builtin && signature.annotated() {
+			checker.arguments(chain, signature, argTypes)
+		}
+		if !signature.generator {
+			result = signature.returns
+		}
+	} else if binding.class != "" {
+		result = simpleType(binding.class)
+	}
+	if chain.Next != nil {
+		return nil
+	}
+	return result
+}
+
+func (checker *typeChecker) arguments(chain *CallChain, signature *funcSignature, argTypes []*TypeExpr) {
+	if len(argTypes) != len(signature.params) {
+		checker.errorf(chain.Pos.String(), "%v expects %v arguments, got: %v", signature.describe(), len(signature.params), len(argTypes))
+		return
+	}
+	for i, param := range signature.params {
+		if !compatible(param.Type, argTypes[i]) {
+			checker.errorf(chain.Pos.String(), "argument %v of %v should be of type %v, got: %v",
+				param.Name, signature.describe(), param.Type, argTypes[i])
+		}
+	}
+}
+
+func (checker *typeChecker) callChain(chain *CallChain, scope *typeScope) {
+	for ; chain != nil; chain = chain.Next {
+		if chain.Args != nil {
+			for _, arg := range chain.Args.Exprs {
+				checker.expr(arg, scope)
+			}
+		} else if chain.Index != nil {
+			checker.expr(chain.Index.Expr, scope)
+		}
+	}
+}
+
+// A list literal has an element type when all of its items agree
+func (checker *typeChecker) listLiteral(listLiteral *ListLiteral, scope *typeScope) *TypeExpr {
+	itemScope := scope
+	if len(listLiteral.Clauses) > 0 {
+		itemScope = checker.clauses(listLiteral.Clauses, scope)
+	}
+	var element *TypeExpr
+	for i, item := range listLiteral.Items {
+		itemType := checker.expr(item, itemScope)
+		if i == 0 {
+			element = itemType
+		} else {
+			element = sameType(element, itemType)
+		}
+	}
+	if element == nil || len(listLiteral.Clauses) > 0 {
+		return simpleType("list")
+	}
+	return &TypeExpr{Name: "list", Params: []*TypeExpr{element}}
+}
+
+func (checker *typeChecker) dictLiteral(dictLiteral *DictLiteral, scope *typeScope) {
+	itemScope := scope
+	if len(dictLiteral.Clauses) > 0 {
+		itemScope = checker.clauses(dictLiteral.Clauses, scope)
+	}
+	for _, item := range dictLiteral.Items {
+		checker.expr(item.KeyExpr, itemScope)
+		checker.expr(item.ValueExpr, itemScope)
+	}
+}
+
+func (checker *typeChecker) clauses(clauses []*ComprehensionClause, scope *typeScope) *typeScope {
+	clauseScope := scope.child()
+	for _, clause := range clauses {
+		if clause.For != nil {
+			checker.forIn(clause.For, clauseScope)
+		} else {
+			checker.expr(clause.Condition, clauseScope)
+		}
+	}
+	return clauseScope
+}
+
+// The primary that an expression consists of, if it has no operators
+func (assignment *Assignment) primary() *Primary {
+	if assignment.Let != nil || assignment.Op != nil {
+		return nil
+	}
+	return assignment.Ternary.primary()
+}
+
+func (ternary *Ternary) primary() *Primary {
+	if ternary.Op != nil || ternary.Nullish.Op != nil {
+		return nil
+	}
+	pipeline := ternary.Nullish.Pipeline
+	if len(pipeline.Stages) > 0 {
+		return nil
+	}
+	logicOr := pipeline.LogicOr
+	if logicOr.Op != nil || logicOr.LogicAnd.Op != nil {
+		return nil
+	}
+	equality := logicOr.LogicAnd.Equality
+	if equality.Op != nil || equality.Comparison.Op != nil {
+		return nil
+	}
+	bitwiseOr := equality.Comparison.BitwiseOr
+	if len(bitwiseOr.Ops) > 0 || len(bitwiseOr.BitwiseXor.Ops) > 0 || len(bitwiseOr.BitwiseXor.BitwiseAnd.Ops) > 0 {
+		return nil
+	}
+	shift := bitwiseOr.BitwiseXor.BitwiseAnd.Shift
+	if len(shift.Ops) > 0 || len(shift.Addition.Ops) > 0 || len(shift.Addition.Multiplication.Ops) > 0 {
+		return nil
+	}
+	unary := shift.Addition.Multiplication.Unary
+	if unary.Op != nil || unary.Power.Op != nil {
+		return nil
+	}
+	return unary.Power.Primary
+}
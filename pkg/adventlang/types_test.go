@@ -0,0 +1,13 @@
+package adventlang
+
+import "testing"
+
+func TestTypeErrorsArentFormatted(t *testing.T) {
+	expectError(t, `let x: number = "a" % 2;`,
+		"test.adv:1:17: '%' can only be used between [number, number], not: [string, number]")
+}
+
+func TestRuntimeErrorsArentFormatted(t *testing.T) {
+	expectError(t, `let a = "a"; a % 2;`,
+		"test.adv:1:14: '%' can only be used between [number, number], not: [string, number]")
+}
@@ -0,0 +1,232 @@
+package adventlang
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Constructors and accessors for Go code that embeds the language, so that
+// it can pass values to programs and read the values they return
+
+func NewUndefined() UndefinedValue {
+	return UndefinedValue{}
+}
+
+func NewNumber(n float64) NumberValue {
+	return NumberValue{val: n}
+}
+
+func NewString(s string) StringValue {
+	return StringValue{val: []byte(s)}
+}
+
+func NewBool(b bool) BoolValue {
+	return BoolValue{val: b}
+}
+
+func NewList(items ...Value) ListValue {
+	listValue := newListValue(len(items))
+	for _, item := range items {
+		listValue.Append(item)
+	}
+	return listValue
+}
+
+func NewDict(entries map[string]Value) DictValue {
+	dictValue := newDictValue(len(entries))
+	for key, value := range entries {
+		dictValue.Set(key, value)
+	}
+	return dictValue
+}
+
+// A Go function that can be called like any other function. A returned
+// error is reported at the position of the call, and a nil value is
+// returned as undefined
+type NativeFunc func(args []Value) (Value, error)
+
+func NewNativeFunction(name string, fn NativeFunc) NativeFunctionValue {
+	return NativeFunctionValue{name: name, Exec: func(frame *StackFrame, position string, args []Value) (Value, error) {
+		value, err := fn(args)
+		if err != nil {
+			// Stopping the program isn't the function's error
+			if isInterruption(err) {
+				return nil, err
+			}
+			return nil, traceError(frame, position, name+": "+err.Error())
+		}
+		if value == nil {
+			return UndefinedValue{}, nil
+		}
+		return value, nil
+	}}
+}
+
+func (numberValue NumberValue) Float64() float64 {
+	return numberValue.val
+}
+
+func (boolValue BoolValue) Bool() bool {
+	return boolValue.val
+}
+
+func (listValue ListValue) Len() int {
+	return len(listValue.val)
+}
+
+// A copy of the list's items in order
+func (listValue ListValue) Items() []Value {
+	items := make([]Value, len(listValue.val))
+	for i := range items {
+		items[i] = *listValue.val[i]
+	}
+	return items
+}
+
+func (dictValue DictValue) Len() int {
+	return len(dictValue.val)
+}
+
+// The dict's keys in sorted order
+func (dictValue DictValue) Keys() []string {
+	keys := make([]string, 0, len(dictValue.val))
+	for key := range dictValue.val {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (dictValue DictValue) Lookup(key string) (Value, bool) {
+	value, ok := dictValue.val[key]
+	if !ok {
+		return nil, false
+	}
+	return *value, true
+}
+
+// Empty for function literals
+func (functionValue FunctionValue) Name() string {
+	return functionValue.name
+}
+
+func (nativeFunctionValue NativeFunctionValue) Name() string {
+	return nativeFunctionValue.name
+}
+
+func (classValue ClassValue) Name() string {
+	return classValue.name
+}
+
+// Convert a Go value to a language value. Numbers of any kind become
+// numbers, slices and arrays become lists, and maps with string keys become
+// dicts. nil is undefined, and Values are returned as they are
+func ToValue(x interface{}) (Value, error) {
+	switch typed := x.(type) {
+	case nil:
+		return UndefinedValue{}, nil
+	case Value:
+		return typed, nil
+	case NativeFunc:
+		return NewNativeFunction("native", typed), nil
+	case func(args []Value) (Value, error):
+		return NewNativeFunction("native", typed), nil
+	case []byte:
+		return StringValue{val: append([]byte{}, typed...)}, nil
+	}
+	reflected := reflect.ValueOf(x)
+	switch reflected.Kind() {
+	case reflect.Bool:
+		return BoolValue{val: reflected.Bool()}, nil
+	case reflect.String:
+		return StringValue{val: []byte(reflected.String())}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NumberValue{val: float64(reflected.Int())}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NumberValue{val: float64(reflected.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return NumberValue{val: reflected.Float()}, nil
+	case reflect.Slice, reflect.Array:
+		listValue := newListValue(reflected.Len())
+		for i := 0; i < reflected.Len(); i++ {
+			item, err := ToValue(reflected.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			listValue.Append(item)
+		}
+		return listValue, nil
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("can't convert %T, dict keys must be strings", x)
+		}
+		dictValue := newDictValue(reflected.Len())
+		iter := reflected.MapRange()
+		for iter.Next() {
+			value, err := ToValue(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			dictValue.Set(iter.Key().String(), value)
+		}
+		return dictValue, nil
+	}
+	return nil, fmt.Errorf("can't convert %T to a value", x)
+}
+
+// Convert a language value to a Go value. Undefined is nil, numbers are
+// float64s, lists are []interface{}, and dicts (including instances of
+// classes) are map[string]interface{}. Functions and classes are returned
+// as they are, they can be called with Interpreter.CallFunction. A list or
+// dict that contains itself can't be converted
+func FromValue(value Value) (interface{}, error) {
+	return fromValue(value, make(map[uintptr]bool))
+}
+
+// `containing` has the lists and dicts that the value is inside of
+func fromValue(value Value, containing map[uintptr]bool) (interface{}, error) {
+	switch typedValue := unref(value).(type) {
+	case UndefinedValue:
+		return nil, nil
+	case NumberValue:
+		return typedValue.val, nil
+	case StringValue:
+		return string(typedValue.val), nil
+	case BoolValue:
+		return typedValue.val, nil
+	case ListValue:
+		id := reflect.ValueOf(typedValue.val).Pointer()
+		if containing[id] {
+			return nil, fmt.Errorf("can't convert a list that contains itself")
+		}
+		containing[id] = true
+		defer delete(containing, id)
+		items := make([]interface{}, len(typedValue.val))
+		for i := range items {
+			item, err := fromValue(*typedValue.val[i], containing)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case DictValue:
+		id := reflect.ValueOf(typedValue.val).Pointer()
+		if containing[id] {
+			return nil, fmt.Errorf("can't convert a dict that contains itself")
+		}
+		containing[id] = true
+		defer delete(containing, id)
+		entries := make(map[string]interface{}, len(typedValue.val))
+		for key, value := range typedValue.val {
+			entry, err := fromValue(*value, containing)
+			if err != nil {
+				return nil, err
+			}
+			entries[key] = entry
+		}
+		return entries, nil
+	}
+	return value, nil
+}
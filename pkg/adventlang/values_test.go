@@ -0,0 +1,104 @@
+package adventlang
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestToValue(t *testing.T) {
+	for _, test := range []struct {
+		x    interface{}
+		want string
+	}{
+		{nil, "undefined"},
+		{1, "1"},
+		{uint8(2), "2"},
+		{1.5, "1.5"},
+		{true, "true"},
+		{"a", "a"},
+		{[]byte("b"), "b"},
+		{[]int{1, 2}, "[1, 2]"},
+		{[2]string{"a", "b"}, "[a, b]"},
+		{map[string]int{"a": 1}, `{"a": 1}`},
+		{NewNumber(3), "3"},
+	} {
+		value, err := ToValue(test.x)
+		if err != nil {
+			t.Fatalf("ToValue(%#v) failed: %v", test.x, err)
+		}
+		if value.String() != test.want {
+			t.Fatalf("ToValue(%#v) is %v, wanted %v", test.x, value, test.want)
+		}
+	}
+}
+
+func TestToValueErrors(t *testing.T) {
+	for _, x := range []interface{}{map[int]int{1: 1}, struct{}{}, []interface{}{make(chan int)}} {
+		if _, err := ToValue(x); err == nil {
+			t.Fatalf("ToValue(%#v) succeeded, wanted an error", x)
+		}
+	}
+}
+
+func TestFromValue(t *testing.T) {
+	x := map[string]interface{}{
+		"n":    1.5,
+		"s":    "a",
+		"b":    true,
+		"none": nil,
+		"list": []interface{}{1.0, "b", []interface{}{}},
+		"dict": map[string]interface{}{"c": 2.0},
+	}
+	value, err := ToValue(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := FromValue(value); err != nil || !reflect.DeepEqual(got, x) {
+		t.Fatalf("FromValue(ToValue(x)) is %#v, %v, wanted %#v", got, err, x)
+	}
+}
+
+func TestFromValueCycles(t *testing.T) {
+	interpreter := NewInterpreter(InterpreterOptions{})
+	for _, source := range []string{
+		`let l = []; l.append(l); l;`,
+		`let d = {}; d["d"] = d; d;`,
+		`let d = {}; d["l"] = [1, [d]]; d;`,
+	} {
+		value, err := interpreter.Eval(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := FromValue(value); err == nil || !strings.Contains(err.Error(), "contains itself") {
+			t.Fatalf("%v: got %#v, %v, wanted an error", source, got, err)
+		}
+	}
+
+	// The same list can be in a list more than once
+	value, err := interpreter.Eval(`let inner = [1]; [inner, inner];`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := FromValue(value)
+	if want := []interface{}{[]interface{}{1.0}, []interface{}{1.0}}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, %v, wanted %#v", got, err, want)
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	list := NewList(NewNumber(1), NewString("a"))
+	if list.Len() != 2 || list.Items()[1].String() != "a" {
+		t.Fatalf("NewList made %v", list)
+	}
+	dict := NewDict(map[string]Value{"b": NewBool(true), "a": NewUndefined()})
+	if keys := dict.Keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Fatalf("NewDict made keys %v", keys)
+	}
+	if value, ok := dict.Lookup("b"); !ok || !value.(BoolValue).Bool() {
+		t.Fatalf("NewDict made %v", dict)
+	}
+	if _, ok := dict.Lookup("c"); ok {
+		t.Fatalf("looked up a missing key")
+	}
+}
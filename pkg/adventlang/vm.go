@@ -0,0 +1,457 @@
+package adventlang
+
+import "fmt"
+
+// A loop that's running, breaks and continues restore its frame and stack
+type loopHandler struct {
+	breakTo    int
+	continueAt int
+	frame      *StackFrame
+	height     int
+}
+
+// The state of a `for in` loop or comprehension clause, kept on the
+// stack while it runs
+type iteration struct {
+	next     iterator
+	iterable Value
+	position string
+	done     bool
+}
+
+func (iteration *iteration) String() string {
+	return "iterator"
+}
+
+func (iteration *iteration) Equals(other Value) (bool, error) {
+	return false, nil
+}
+
+// Close the iterators of the loops that a break, continue, return, or error
+// leaves, innermost first. Like iterate, an error from closing one replaces
+// a break or return, but not an error
+func closeIterations(frame *StackFrame, stack []Value, err error) error {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if current, okIteration := stack[i].(*iteration); okIteration && !current.done {
+			current.done = true
+			closeErr := closeIterator(frame, current.position, current.iterable)
+			if closeErr != nil && (err == nil || isControlFlow(err)) {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func execProgram(frame *StackFrame, code *chunk) (Value, error) {
+	// Compiling may have added globals
+	for len(frame.slots) < len(frame.scope.names) {
+		frame.slots = append(frame.slots, nil)
+	}
+	value, err := execChunk(frame, code)
+	if err != nil {
+		return nil, checkLabel(frame, err)
+	}
+	return unwrap(value, frame)
+}
+
+// Run a function's compiled body in the frame its parameters are bound in
+func execFunction(callFrame *StackFrame, code *chunk) (Value, error) {
+	value, err := execChunk(callFrame, code)
+	if err != nil {
+		return nil, checkLabel(callFrame, err)
+	}
+	return value, nil
+}
+
+func execChunk(frame *StackFrame, code *chunk) (Value, error) {
+	stack := make([]Value, 0, 16)
+	loops := make([]loopHandler, 0)
+	var result Value = UndefinedValue{}
+	var err error
+
+	instructions := code.code
+	pc := 0
+	for {
+		instruction := &instructions[pc]
+		pc++
+		switch instruction.op {
+		case opConstant:
+			stack = append(stack, code.constants[instruction.a])
+		case opUndefined:
+			stack = append(stack, UndefinedValue{})
+		case opPop:
+			stack = stack[:len(stack)-1]
+		case opUnref:
+			stack[len(stack)-1] = unref(stack[len(stack)-1])
+		case opGetVar:
+			variable := code.variables[instruction.a]
+			_, value := variable.lookup(frame)
+			if value == nil {
+				err = fmt.Errorf("variable not declared: %v", variable.name)
+				if instruction.position != "" {
+					err = traceError(frame, instruction.position, err.Error())
+				}
+				break
+			}
+			stack = append(stack, *value)
+		case opIdentifier:
+			stack = append(stack, IdentifierValue{val: code.names[instruction.a]})
+		case opAssign, opLet, opConst:
+			err = assignSlot(frame, code, instruction, stack[len(stack)-1])
+		case opDeclare:
+			frame.slots[instruction.a] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case opStoreRef:
+			right := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			_, err = assignReference(frame, instruction.position, stack[len(stack)-1], right)
+			stack[len(stack)-1] = right
+		case opBinary:
+			left, right := unref(stack[len(stack)-2]), unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1], err = evalBinary(frame, instruction.a, instruction.position,
+				code.names[instruction.b], left, right)
+		case opAdd, opSubtract, opMultiply, opLess, opLessEqual, opGreater, opGreaterEqual, opEqual, opNotEqual:
+			left, right := unref(stack[len(stack)-2]), unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1], err = numberOperator(frame, instruction, left, right)
+		case opUnary:
+			stack[len(stack)-1], err = evalUnary(frame, instruction.position, code.names[instruction.b],
+				unref(stack[len(stack)-1]))
+		case opJump:
+			pc = instruction.a
+		case opTernary, opIf:
+			condition := unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			errorFrame := frame
+			if instruction.op == opIf {
+				errorFrame = frame.parent
+			}
+			var ok bool
+			ok, err = isTrue(errorFrame, instruction.position, condition)
+			if err == nil && !ok {
+				pc = instruction.a
+			}
+		case opLoopCondition:
+			condition := unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			var ok bool
+			ok, err = isLoopCondition(frame, instruction.position, condition)
+			if err == nil && !ok {
+				pc = instruction.a
+			}
+		case opNullish:
+			value := unref(stack[len(stack)-1])
+			if _, okUndefined := value.(UndefinedValue); okUndefined {
+				stack = stack[:len(stack)-1]
+			} else {
+				stack[len(stack)-1] = value
+				pc = instruction.a
+			}
+		case opOptional:
+			if _, okUndefined := unref(stack[len(stack)-1]).(UndefinedValue); okUndefined {
+				stack[len(stack)-1] = UndefinedValue{}
+				pc = instruction.a
+			}
+		case opIndex:
+			index := unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1], err = indexValue(frame, instruction.position, code.names[instruction.b],
+				unref(stack[len(stack)-1]), index, instruction.a == 1)
+		case opProperty:
+			stack[len(stack)-1], err = propertyValue(frame, instruction.position, unref(stack[len(stack)-1]),
+				code.names[instruction.a], instruction.b&propertyCalled != 0, instruction.b&propertyOptional != 0)
+		case opCall, opCallPiped, opTailCall:
+			base := len(stack) - instruction.a
+			function := unref(stack[base-1])
+			args := make([]Value, 0, instruction.a+1)
+			if instruction.op == opCallPiped {
+				// The piped value is below the function
+				args = append(args, unref(stack[base-2]))
+				base--
+			}
+			for _, arg := range stack[len(stack)-instruction.a:] {
+				args = append(args, unref(arg))
+			}
+			stack = stack[:base-1]
+			if instruction.op == opTailCall {
+				// Calls in tail position run in the caller's `Exec`
+				if functionValue, okFunction := function.(FunctionValue); okFunction && !functionValue.generator {
+					if err = closeIterations(frame, stack, nil); err != nil {
+						break
+					}
+					return tailCall{function: functionValue, position: instruction.position, args: args}, nil
+				}
+			}
+			var value Value
+			value, err = callFunction(frame, instruction.position, function, args)
+			if err != nil {
+				break
+			}
+			if instruction.op == opTailCall {
+				if err = closeIterations(frame, stack, nil); err != nil {
+					break
+				}
+				return unref(value), nil
+			}
+			stack = append(stack, value)
+		case opPipe:
+			function := unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1], err = pipeTo(frame, instruction.position, function, unref(stack[len(stack)-1]))
+		case opNip:
+			stack[len(stack)-2] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case opReturn:
+			if err = closeIterations(frame, stack, nil); err != nil {
+				break
+			}
+			return unref(stack[len(stack)-1]), nil
+		case opReturnOutside:
+			err = ReturnError{val: unref(stack[len(stack)-1])}
+		case opYield:
+			stack[len(stack)-1], err = yieldValue(frame, instruction.position, unref(stack[len(stack)-1]))
+		case opPushFrame:
+			frame = frame.child(code.names[instruction.a], code.scopes[instruction.b])
+		case opPopFrame:
+			frame = frame.parent
+		case opClosure:
+			template := code.functions[instruction.a]
+			stack = append(stack, FunctionValue{
+				name:       template.name,
+				position:   template.position,
+				parameters: template.parameters,
+				types:      template.types,
+				frame:      frame,
+				statements: template.statements,
+				generator:  template.generator,
+				code:       template.code,
+			})
+		case opClass:
+			template := code.classes[instruction.a]
+			frame.slots[instruction.b] = ClassValue{
+				name:    template.name,
+				frame:   frame,
+				members: template.members,
+				code:    template.code,
+				scope:   template.scope,
+			}
+		case opList:
+			if limit := frame.runtime.allocate(instruction.a * listItemSize); limit != nil {
+				err = limit.at(frame, instruction.position)
+				break
+			}
+			values := make(map[int]*Value, instruction.a)
+			items := stack[len(stack)-instruction.a:]
+			for i := range items {
+				value := unref(items[i])
+				values[i] = &value
+			}
+			stack = stack[:len(stack)-instruction.a]
+			stack = append(stack, ListValue{val: values, frozen: new(bool)})
+		case opNewList:
+			stack = append(stack, newListValue(0))
+		case opNewDict:
+			stack = append(stack, newDictValue(0))
+		case opAppend:
+			if limit := frame.runtime.allocate(listItemSize); limit != nil {
+				err = limit.at(frame, instruction.position)
+				break
+			}
+			value := unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1-instruction.a].(ListValue).Append(value)
+		case opDictItem:
+			key, value := unref(stack[len(stack)-2]), unref(stack[len(stack)-1])
+			stack = stack[:len(stack)-2]
+			err = setDictItem(frame, instruction.position, stack[len(stack)-1-instruction.a].(DictValue), key, value)
+		case opIterate:
+			iterable := unref(stack[len(stack)-1])
+			var next iterator
+			next, err = getIterator(frame, instruction.position, iterable)
+			stack[len(stack)-1] = &iteration{next: next, iterable: iterable, position: instruction.position}
+		case opNext:
+			current := stack[len(stack)-1].(*iteration)
+			var key, value Value
+			var done bool
+			key, value, done, err = current.next()
+			if err != nil {
+				// The iterator failed, there's nothing to close
+				current.done = true
+				break
+			}
+			if done {
+				current.done = true
+				pc = instruction.a
+			} else if instruction.b == 2 {
+				stack = append(stack, key, value)
+			} else {
+				stack = append(stack, iterationItem(current.iterable, key, value))
+			}
+		case opEndIterate:
+			err = closeIterations(frame, stack[len(stack)-1:], nil)
+			stack = stack[:len(stack)-1]
+		case opPushLoop:
+			loops = append(loops, loopHandler{
+				breakTo:    instruction.a,
+				continueAt: instruction.b,
+				frame:      frame,
+				height:     len(stack),
+			})
+		case opPopLoop:
+			loops = loops[:len(loops)-1]
+		case opBreak, opContinue:
+			loops = loops[:len(loops)-instruction.a]
+			handler := loops[len(loops)-1]
+			err = closeIterations(frame, stack[handler.height:], nil)
+			frame, stack = handler.frame, stack[:handler.height]
+			if err != nil {
+				break
+			}
+			if instruction.op == opBreak {
+				pc = handler.breakTo
+			} else {
+				pc = handler.continueAt
+			}
+		case opBreakError:
+			breakErr := BreakError{position: instruction.position}
+			if instruction.a != -1 {
+				breakErr.label = code.names[instruction.a]
+			}
+			err = breakErr
+		case opContinueError:
+			contErr := ContinueError{position: instruction.position}
+			if instruction.a != -1 {
+				contErr.label = code.names[instruction.a]
+			}
+			err = contErr
+		case opError:
+			err = traceError(frame, instruction.position, code.names[instruction.a])
+		case opSetResult:
+			result = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case opResult:
+			stack = append(stack, result)
+		case opStep:
+			if stop := frame.runtime.step(); stop != nil {
+				err = stop.at(frame, instruction.position)
+			}
+		default:
+			panic("unreachable")
+		}
+
+		if err != nil {
+			// A function that breaks or continues outside of a loop
+			// escapes to its caller's innermost loop
+			if len(loops) == 0 {
+				return nil, closeIterations(frame, stack, err)
+			}
+			handler := loops[len(loops)-1]
+			if breakErr, okBreak := err.(BreakError); okBreak && breakErr.label == "" {
+				pc = handler.breakTo
+			} else if contErr, okCont := err.(ContinueError); okCont && contErr.label == "" {
+				pc = handler.continueAt
+			} else {
+				return nil, closeIterations(frame, stack, err)
+			}
+			err = closeIterations(frame, stack[handler.height:], nil)
+			frame, stack = handler.frame, stack[:handler.height]
+		}
+	}
+}
+
+// The frame that declares a variable and its slot, nil if it isn't declared
+func (variable *variable) lookup(frame *StackFrame) (*StackFrame, *Value) {
+	depth := 0
+	for _, address := range variable.addresses {
+		for ; depth < address.depth; depth++ {
+			frame = frame.parent
+		}
+		if address.slot < len(frame.slots) && frame.slots[address.slot] != nil {
+			return frame, &frame.slots[address.slot]
+		}
+	}
+	return nil, nil
+}
+
+// The same as `assignVariable` but with the variable's slots
+func assignSlot(frame *StackFrame, code *chunk, instruction *instruction, value Value) error {
+	variable := code.variables[instruction.a]
+	if instruction.op == opConst {
+		// Constants are declared in the current scope. A loop body
+		// may run the same declaration again
+		position := code.names[instruction.b]
+		if declared, okConst := frame.constants[variable.name]; okConst && declared != position {
+			return traceError(frame, instruction.position, "can't reassign constant: "+variable.name)
+		}
+		if frame.constants == nil {
+			frame.constants = make(map[string]string)
+		}
+		frame.constants[variable.name] = position
+		frame.slots[variable.local] = value
+		return nil
+	}
+	declaring, slot := variable.lookup(frame)
+	if slot == nil {
+		if instruction.op == opAssign {
+			return traceError(frame, instruction.position, "can't assign to unknown variable: "+variable.name)
+		}
+		frame.slots[variable.local] = value
+		return nil
+	}
+	if _, okConst := declaring.constants[variable.name]; okConst {
+		return traceError(frame, instruction.position, "can't reassign constant: "+variable.name)
+	}
+	*slot = value
+	return nil
+}
+
+// Arithmetic and comparisons between numbers skip the operator's full checks
+func numberOperator(frame *StackFrame, instruction *instruction, left Value, right Value) (Value, error) {
+	leftNum, okLeft := left.(NumberValue)
+	rightNum, okRight := right.(NumberValue)
+	if okLeft && okRight {
+		switch instruction.op {
+		case opAdd:
+			return NumberValue{val: leftNum.val + rightNum.val}, nil
+		case opSubtract:
+			return NumberValue{val: leftNum.val - rightNum.val}, nil
+		case opMultiply:
+			return NumberValue{val: leftNum.val * rightNum.val}, nil
+		case opLess:
+			return BoolValue{val: leftNum.val < rightNum.val}, nil
+		case opLessEqual:
+			return BoolValue{val: leftNum.val <= rightNum.val}, nil
+		case opGreater:
+			return BoolValue{val: leftNum.val > rightNum.val}, nil
+		case opGreaterEqual:
+			return BoolValue{val: leftNum.val >= rightNum.val}, nil
+		case opEqual:
+			return BoolValue{val: leftNum.val == rightNum.val}, nil
+		case opNotEqual:
+			return BoolValue{val: leftNum.val != rightNum.val}, nil
+		}
+	}
+	switch instruction.op {
+	case opAdd:
+		return evalAddition(frame, instruction.position, "+", left, right)
+	case opSubtract:
+		return evalAddition(frame, instruction.position, "-", left, right)
+	case opMultiply:
+		return evalMultiplication(frame, instruction.position, "*", left, right)
+	case opLess:
+		return evalComparison(frame, instruction.position, "<", left, right)
+	case opLessEqual:
+		return evalComparison(frame, instruction.position, "<=", left, right)
+	case opGreater:
+		return evalComparison(frame, instruction.position, ">", left, right)
+	case opGreaterEqual:
+		return evalComparison(frame, instruction.position, ">=", left, right)
+	case opEqual:
+		return evalEquality(frame, instruction.position, "==", left, right)
+	case opNotEqual:
+		return evalEquality(frame, instruction.position, "!=", left, right)
+	}
+	panic("unreachable")
+}
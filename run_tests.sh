@@ -1 +1,4 @@
 go run cmd/adventlang.go tests/__run_tests.adv
+go run cmd/adventlang.go -tree-walker tests/__run_tests.adv
+go run cmd/adventlang.go -no-opt tests/__run_tests.adv
+go test ./pkg/...
@@ -2,25 +2,48 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"syscall/js"
+	"time"
 
 	"github.com/healeycodes/adventlang/pkg/adventlang"
 )
 
+// Programs that never finish would freeze the playground's worker
+var limits = adventlang.Options{
+	Timeout:   10 * time.Second,
+	MaxMemory: 512 << 20,
+}
+
 func main() {
 	js.Global().Set("adventlang", js.FuncOf(run))
 	c := make(chan struct{}, 0)
 	<-c
 }
 
+// Returns everything the program printed, followed by its error if it failed.
+// The second argument is an optional object of files by their paths, which
+// programs can import and read. There's no access to the host's files
 func run(this js.Value, args []js.Value) interface{} {
-	if len(args) != 1 {
-		return js.ValueOf("error: run(source) takes a single argument")
+	if len(args) != 1 && len(args) != 2 {
+		return js.ValueOf("error: run(source, files) takes one or two arguments")
+	}
+	files := adventlang.MemoryFS{}
+	if len(args) == 2 && args[1].Type() == js.TypeObject {
+		paths := js.Global().Get("Object").Call("keys", args[1])
+		for i := 0; i < paths.Length(); i++ {
+			path := paths.Index(i).String()
+			files[path] = args[1].Get(path).String()
+		}
 	}
-	result, _, err := adventlang.RunProgram("web", args[0].String())
+	var output strings.Builder
+	options := limits
+	options.FS = files
+	options.Stdout, options.Stderr = &output, &output
+	_, _, err := adventlang.RunProgramWithOptions("web", args[0].String(), options)
 	if err != nil {
-		return js.ValueOf(fmt.Sprintf("uh oh..\n\n %v", err.Error()))
+		fmt.Fprintf(&output, "uh oh..\n\n %v", err.Error())
 	}
 
-	return js.ValueOf(result)
+	return js.ValueOf(output.String())
 }